@@ -48,6 +48,9 @@ const (
 	// The default maximum number of ranges to return from a range
 	// lookup.
 	defaultRangeLookupMaxRanges = 8
+	// The default number of times a read-only batch is retried against the
+	// same replica on a transient error before failing over.
+	defaultReadRetries = 1
 	// The default size of the leader cache.
 	defaultLeaderCacheSize = 1 << 16
 	// The default size of the range descriptor cache.
@@ -237,7 +240,7 @@ func (ds *DistSender) RangeLookup(key roachpb.RKey, desc *roachpb.RangeDescripto
 	defer trace.Finish()
 	// TODO(tschottdorf): Ideally we would use the trace of the request which
 	// caused this lookup instead of a new one.
-	br, err := ds.sendRPC(trace, desc.RangeID, replicas, orderRandom, ba)
+	br, err := ds.sendRPC(context.Background(), trace, desc.RangeID, replicas, orderRandom, ba)
 	if err != nil {
 		return nil, err
 	}
@@ -319,9 +322,9 @@ func (ds *DistSender) getNodeDescriptor() *roachpb.NodeDescriptor {
 // leader) and then sent via Send, with requirement that one RPC to a server
 // must succeed. Returns an RPC error if the request could not be sent. Note
 // that the reply may contain a higher level error and must be checked in
-// addition to the RPC error.
-// TODO(tschottdorf): should take a context instead of a Span.
-func (ds *DistSender) sendRPC(sp opentracing.Span, rangeID roachpb.RangeID, replicas ReplicaSlice,
+// addition to the RPC error. Cancelling ctx cancels the RPCs in flight.
+// TODO(tschottdorf): should take the Span from the context.
+func (ds *DistSender) sendRPC(ctx context.Context, sp opentracing.Span, rangeID roachpb.RangeID, replicas ReplicaSlice,
 	order orderingPolicy, ba roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
 	if len(replicas) == 0 {
 		return nil, roachpb.NewError(noNodeAddrsAvailError{})
@@ -338,6 +341,8 @@ func (ds *DistSender) sendRPC(sp opentracing.Span, rangeID roachpb.RangeID, repl
 		SendNextTimeout: defaultSendNextTimeout,
 		Timeout:         base.NetworkTimeout,
 		Trace:           sp,
+		Context:         ctx,
+		ReadRetries:     defaultReadRetries,
 	}
 	tracing.AnnotateTrace()
 	defer tracing.AnnotateTrace()
@@ -390,7 +395,7 @@ func (ds *DistSender) getDescriptors(rs roachpb.RSpan, considerIntents, useRever
 }
 
 // sendSingleRange gathers and rearranges the replicas, and makes an RPC call.
-func (ds *DistSender) sendSingleRange(trace opentracing.Span, ba roachpb.BatchRequest, desc *roachpb.RangeDescriptor) (*roachpb.BatchResponse, *roachpb.Error) {
+func (ds *DistSender) sendSingleRange(ctx context.Context, trace opentracing.Span, ba roachpb.BatchRequest, desc *roachpb.RangeDescriptor) (*roachpb.BatchResponse, *roachpb.Error) {
 	trace.LogEvent(fmt.Sprintf("sending RPC to [%s, %s)", desc.StartKey, desc.EndKey))
 
 	leader := ds.leaderCache.Lookup(roachpb.RangeID(desc.RangeID))
@@ -422,7 +427,7 @@ func (ds *DistSender) sendSingleRange(trace opentracing.Span, ba roachpb.BatchRe
 	ba.SetNewRequest()
 
 	// TODO(tschottdorf): should serialize the trace here, not higher up.
-	br, pErr := ds.sendRPC(trace, desc.RangeID, replicas, order, ba)
+	br, pErr := ds.sendRPC(ctx, trace, desc.RangeID, replicas, order, ba)
 	if pErr != nil {
 		return nil, pErr
 	}
@@ -640,7 +645,7 @@ func (ds *DistSender) sendChunk(ctx context.Context, ba roachpb.BatchRequest) (*
 				}
 				truncBA.MaxScanResults = ba.MaxScanResults
 
-				return ds.sendSingleRange(sp, truncBA, desc)
+				return ds.sendSingleRange(ctx, sp, truncBA, desc)
 			}()
 			// If sending succeeded, break this loop.
 			if pErr == nil {
@@ -418,6 +418,46 @@ func TestOwnNodeCertain(t *testing.T) {
 
 }
 
+// TestSendRPCContext verifies that the context of a batch sent through the
+// DistSender is the parent of the contexts of the RPCs it sends, so that
+// cancelling it cancels those RPCs.
+func TestSendRPCContext(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	g, s := makeTestGossip(t)
+	defer s()
+	if err := g.SetNodeDescriptor(&roachpb.NodeDescriptor{NodeID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	nd := &roachpb.NodeDescriptor{
+		NodeID:  1,
+		Address: util.MakeUnresolvedAddr("tcp", "node1"),
+	}
+	if err := g.AddInfoProto(gossip.MakeNodeIDKey(1), nd, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	sendCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var testFn rpcSendFn = func(o SendOptions, _ ReplicaSlice,
+		ba roachpb.BatchRequest, _ *rpc.Context) (*roachpb.BatchResponse, error) {
+		if o.Context == nil || o.Context.Err() != context.Canceled {
+			t.Errorf("expected the cancelled context to be passed in, got %v", o.Context)
+		}
+		return ba.CreateReply(), nil
+	}
+	ctx := &DistSenderContext{
+		RPCSend: testFn,
+		RangeDescriptorDB: mockRangeDescriptorDB(func(_ roachpb.RKey, _, _ bool) ([]roachpb.RangeDescriptor, *roachpb.Error) {
+			return []roachpb.RangeDescriptor{testRangeDescriptor}, nil
+		}),
+	}
+	ds := NewDistSender(ctx, g)
+	if _, err := client.SendWrapped(ds, sendCtx, roachpb.NewGet(roachpb.Key("a"))); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // TestRetryOnNotLeaderError verifies that the DistSender correctly updates the
 // leader cache and retries when receiving a NotLeaderError.
 func TestRetryOnNotLeaderError(t *testing.T) {
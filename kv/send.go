@@ -21,11 +21,16 @@ import (
 	"io"
 	"math/rand"
 	"os"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/cockroachdb/cockroach/roachpb"
 	"github.com/cockroachdb/cockroach/rpc"
@@ -41,10 +46,80 @@ type orderingPolicy int
 const (
 	// orderStable uses endpoints in the order provided.
 	orderStable = iota
-	// orderRandom randomly orders available endpoints.
+	// orderRandom randomly orders available endpoints, trying healthy ones
+	// first.
 	orderRandom
+	// orderWeightedRandom starts with a healthy endpoint chosen at random,
+	// weighted inversely by its round-trip time, followed by the remaining
+	// healthy and then the unhealthy endpoints in the order provided.
+	orderWeightedRandom
+	// orderClosest uses healthy endpoints by ascending round-trip time,
+	// followed by the remaining endpoints in the order provided.
+	orderClosest
 )
 
+// verificationMode is an enum for how replies are checked for integrity
+// against the requests which produced them.
+type verificationMode int
+
+const (
+	// verifyOff skips reply verification.
+	verifyOff = iota
+	// verifyLog logs verification failures but returns the reply.
+	verifyLog
+	// verifyFail turns a verification failure into an error and drops
+	// the reply.
+	verifyFail
+)
+
+// A BatchHandler sends a batch to a single replica.
+type BatchHandler func(context.Context, *roachpb.BatchRequest) (*roachpb.BatchResponse, error)
+
+// A BatchInterceptor wraps the dispatch of a batch to a single replica, on
+// both the local and the RPC path. It must call next to continue the
+// dispatch, unless it chooses to reply itself.
+type BatchInterceptor func(ctx context.Context, args *roachpb.BatchRequest,
+	next BatchHandler) (*roachpb.BatchResponse, error)
+
+// chainInterceptors returns a BatchHandler which runs the interceptors, the
+// first one outermost, around handler.
+func chainInterceptors(interceptors []BatchInterceptor, handler BatchHandler) BatchHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, args *roachpb.BatchRequest) (*roachpb.BatchResponse, error) {
+			return interceptor(ctx, args, next)
+		}
+	}
+	return handler
+}
+
+// A LatencySource estimates the round-trip time to the node at addr. It
+// returns false if no estimate is available.
+type LatencySource interface {
+	Latency(addr string) (time.Duration, bool)
+}
+
+var _ LatencySource = &rpc.RemoteClockMonitor{}
+
+// replicaKey and remoteAddrKey are the context keys under which sendOne
+// records the replica targeted by an RPC and its address.
+type replicaKey struct{}
+type remoteAddrKey struct{}
+
+// ReplicaFromContext returns the replica targeted by the RPC with context ctx,
+// for use by BatchInterceptors.
+func ReplicaFromContext(ctx context.Context) (roachpb.ReplicaDescriptor, bool) {
+	replica, ok := ctx.Value(replicaKey{}).(roachpb.ReplicaDescriptor)
+	return replica, ok
+}
+
+// RemoteAddrFromContext returns the address of the replica targeted by the
+// RPC with context ctx, for use by BatchInterceptors.
+func RemoteAddrFromContext(ctx context.Context) (string, bool) {
+	addr, ok := ctx.Value(remoteAddrKey{}).(string)
+	return addr, ok
+}
+
 // A SendOptions structure describes the algorithm for sending RPCs to one or
 // more replicas, depending on error conditions and how many successful
 // responses are required.
@@ -55,11 +130,108 @@ type SendOptions struct {
 	// SendNextTimeout is the duration after which RPCs are sent to
 	// other replicas in a set.
 	SendNextTimeout time.Duration
+	// DegradedSendNextTimeout, if nonzero, replaces SendNextTimeout after
+	// an RPC to an unhealthy replica, as determined for ordering, so that
+	// replicas which may merely be slow to respond during cluster-wide
+	// trouble are given longer before the next one is tried. Sending to an
+	// unhealthy replica is then also noted in the trace.
+	DegradedSendNextTimeout time.Duration
 	// Timeout is the maximum duration of an RPC before failure.
 	// 0 for no timeout.
 	Timeout time.Duration
+	// ReadRetries is the number of times a read-only batch is retried
+	// against the same replica on a transient connection error before the
+	// error is returned. Each retry backs off according to readRetryOptions
+	// and waits for the connection to become ready again. Writes are never
+	// retried.
+	ReadRetries int
+	// SoftTimeout, if nonzero, is the duration after which an RPC still
+	// outstanding, counting from its dispatch and including local calls, is
+	// logged as slow. Its reply, if received by send, is also noted in the
+	// trace. Unlike Timeout, it does not fail the RPC.
+	SoftTimeout time.Duration
+	// OverallDeadline bounds the time spent on all attempts combined: no RPC
+	// outlives it and no further replicas are tried once it has passed.
+	// The zero value means no overall deadline.
+	OverallDeadline time.Time
 	// Information about the request is added to this trace. Must not be nil.
 	Trace opentracing.Span
+	// Context is the parent of the contexts of the RPCs sent. If nil,
+	// context.Background() is used.
+	Context context.Context
+	// FallbackLocalToRemote, if set, causes a call to the local server
+	// which returns an error to be retried via RPC against the same replica
+	// instead of returning the local error. Errors carried in the reply,
+	// which is how Node.Batch reports the outcome of executing the batch,
+	// are returned as they are: the RPC would reach the same store, and
+	// would execute a write a second time.
+	FallbackLocalToRemote bool
+	// Interceptors are run around the dispatch of the batch to each replica,
+	// the first one outermost.
+	Interceptors []BatchInterceptor
+	// RewriteForAttempt, if set, is called to adjust the batch before it is
+	// sent for the given attempt, counting from one. args is a copy of the
+	// batch, but shares its requests with the other attempts; they must be
+	// replaced rather than modified in place.
+	RewriteForAttempt func(attempt int, args *roachpb.BatchRequest)
+	// OnDispatch, if set, is called with the address and the batch before
+	// each replica is sent to, in the order the replicas are tried.
+	OnDispatch func(addr string, args roachpb.BatchRequest)
+	// CancelPreviousAttempt, if set, cancels the attempt in flight whenever
+	// the next replica is tried, so that at most one RPC is outstanding.
+	CancelPreviousAttempt bool
+	// IsolateLocalArgs, if set, passes a deep copy of the batch to the
+	// local server, so that, as with an RPC, the server cannot modify the
+	// caller's batch.
+	IsolateLocalArgs bool
+	// DisableLocalCalls, if set, sends RPCs even to a replica served by the
+	// local server. Local calls are also disabled process-wide by setting
+	// the ENABLE_LOCAL_CALLS environment variable to 0.
+	DisableLocalCalls bool
+	// LatencySource, if set, provides the round-trip times by which replicas
+	// are ordered. By default, the estimates of the RemoteClockMonitor of
+	// the rpc.Context are used.
+	LatencySource LatencySource
+	// HealthProbe, if set, reports whether the replica at addr is healthy
+	// for the purpose of ordering, in place of the state of its connection.
+	HealthProbe func(addr string) bool
+	// Semaphore, if set, bounds the number of RPCs in flight across all
+	// sends sharing it: each RPC holds a slot of the buffered channel while
+	// it is outstanding. Waiting for a slot is abandoned when the context of
+	// the RPC is done.
+	Semaphore chan struct{}
+	// SkipUnhealthy, if set, restricts sending to the healthy replicas,
+	// unless none are healthy.
+	SkipUnhealthy bool
+	// MinHealthyReplicas, if positive, causes send to fail without sending
+	// anything unless at least that many replicas are healthy, as
+	// determined for ordering.
+	MinHealthyReplicas int
+	// ExcludedNodes are not sent to while replicas on other nodes remain,
+	// allowing a misbehaving node to be avoided. If every replica is on an
+	// excluded node, they are all tried anyway.
+	ExcludedNodes map[roachpb.NodeID]struct{}
+	// VerificationMode indicates whether and how replies are verified
+	// against the requests in the batch.
+	VerificationMode verificationMode
+	// VerificationSampleRate, if greater than one, limits verification to
+	// one in VerificationSampleRate responses, chosen at random, to save
+	// CPU on large replies.
+	VerificationSampleRate int
+	// VerificationSeed, if nonzero, seeds the choice of the responses to
+	// verify, so that the same responses are verified whenever the batch is
+	// sent with the same seed.
+	VerificationSeed int64
+	// RandomizeTies, if set, causes orderClosest to try the healthy
+	// replicas with equal round-trip times, such as those whose round-trip
+	// time is not yet known, in random order instead of the order provided,
+	// so that load is spread among them.
+	RandomizeTies bool
+	// Rand, if set, is the source of randomness for the random orderings,
+	// so that the order in which replicas are tried can be reproduced. It
+	// must not be shared by concurrent sends. If nil, the global source is
+	// used.
+	Rand *rand.Rand
 }
 
 // An rpcError indicates a failure to send the RPC. rpcErrors are
@@ -80,23 +252,368 @@ func newRPCError(err error) rpcError {
 // and without a positive outlook.
 func (r rpcError) CanRetry() bool { return true }
 
+// An insufficientHealthyReplicasError is returned by send when fewer replicas
+// are healthy than required by SendOptions.MinHealthyReplicas. It is not
+// retryable: the point of the check is to fail fast, which DistSender's
+// unbounded retries would defeat.
+type insufficientHealthyReplicasError struct {
+	healthy, required int
+}
+
+// Error implements the error interface.
+func (e insufficientHealthyReplicasError) Error() string {
+	return fmt.Sprintf("insufficient healthy replicas (%d) to satisfy minimum of %d",
+		e.healthy, e.required)
+}
+
+// CanRetry implements the Retryable interface.
+func (e insufficientHealthyReplicasError) CanRetry() bool { return false }
+
 type batchClient struct {
 	remoteAddr string
 	conn       *grpc.ClientConn
 	client     roachpb.InternalClient
 	args       roachpb.BatchRequest
+	// rtt is the estimated round-trip time to remoteAddr, or 0 if unknown.
+	rtt time.Duration
+}
+
+// batchClientsPool recycles the backing arrays of the client slices built
+// by send. It holds pointers to slices to avoid an allocation on every Put.
+var batchClientsPool = sync.Pool{
+	New: func() interface{} { return new([]batchClient) },
+}
+
+// putBatchClients clears clients, so that the pool doesn't retain references
+// to connections or requests, and returns it to the pool via p.
+func putBatchClients(p *[]batchClient, clients []batchClient) {
+	for i := range clients {
+		clients[i] = batchClient{}
+	}
+	*p = clients[:0]
+	batchClientsPool.Put(p)
+}
+
+// rttLess reports whether the round-trip time a is shorter than b, where a
+// round-trip time of 0 is unknown and longer than any known one.
+func rttLess(a, b time.Duration) bool {
+	return a != 0 && (b == 0 || a < b)
+}
+
+// byHealthAndRTT sorts the indexes in order by the health and round-trip
+// times they refer to; see OrderByHealthAndRTT.
+type byHealthAndRTT struct {
+	order   []int
+	healthy []bool
+	rtts    []time.Duration
+}
+
+func (o byHealthAndRTT) Len() int      { return len(o.order) }
+func (o byHealthAndRTT) Swap(i, j int) { o.order[i], o.order[j] = o.order[j], o.order[i] }
+func (o byHealthAndRTT) Less(i, j int) bool {
+	a, b := o.order[i], o.order[j]
+	if o.healthy[a] != o.healthy[b] {
+		return o.healthy[a]
+	}
+	return o.healthy[a] && rttLess(o.rtts[a], o.rtts[b])
+}
+
+// OrderByHealthAndRTT returns the order, as indexes into healthy and rtts, in
+// which to try a set of replicas, given whether each is healthy and its
+// estimated round-trip time (0 if unknown). Healthy replicas come first, by
+// ascending round-trip time with unknown ones last, followed by the
+// unhealthy replicas in the order provided.
+func OrderByHealthAndRTT(healthy []bool, rtts []time.Duration) []int {
+	order := make([]int, len(healthy))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Stable(byHealthAndRTT{order: order, healthy: healthy, rtts: rtts})
+	return order
+}
+
+// isHealthy reports whether client is healthy: if probe reports so for its
+// address or, if probe is nil, if its connection is ready.
+func isHealthy(client batchClient, probe func(addr string) bool) (bool, error) {
+	if probe != nil {
+		return probe(client.remoteAddr), nil
+	}
+	clientState, err := client.conn.State()
+	if err != nil {
+		return false, err
+	}
+	return clientState == grpc.Ready, nil
+}
+
+// splitHealthy moves the healthy clients, as determined by isHealthy, to the
+// front of clients, keeping the relative order of both the healthy and the
+// unhealthy clients, and returns the number of healthy ones.
+func splitHealthy(clients []batchClient, probe func(addr string) bool) (int, error) {
+	var nHealthy int
+	for i, client := range clients {
+		healthy, err := isHealthy(client, probe)
+		if err != nil {
+			return 0, err
+		}
+		if healthy {
+			// Shift the unhealthy clients seen so far back by one to make
+			// room for this one; there are few enough replicas for this to
+			// be cheaper than allocating.
+			copy(clients[nHealthy+1:i+1], clients[nHealthy:i])
+			clients[nHealthy] = client
+			nHealthy++
+		}
+	}
+	return nHealthy, nil
+}
+
+// pickByInverseRTT moves a client chosen at random, weighted by the inverse of
+// its round-trip time, to the front of clients. The order of the remaining
+// clients is preserved. Clients with an unknown round-trip time are weighted
+// like the slowest known one. float64Fn must return a value in [0, 1).
+func pickByInverseRTT(clients []batchClient, float64Fn func() float64) {
+	if len(clients) < 2 {
+		return
+	}
+	var maxRTT time.Duration
+	for _, client := range clients {
+		if client.rtt > maxRTT {
+			maxRTT = client.rtt
+		}
+	}
+	if maxRTT == 0 {
+		// No round-trip times are known; weigh all clients equally.
+		maxRTT = 1
+	}
+	weights := make([]float64, len(clients))
+	var total float64
+	for i, client := range clients {
+		rtt := client.rtt
+		if rtt == 0 {
+			rtt = maxRTT
+		}
+		weights[i] = 1 / float64(rtt)
+		total += weights[i]
+	}
+	target := float64Fn() * total
+	chosen := len(clients) - 1
+	for i, w := range weights {
+		if target < w {
+			chosen = i
+			break
+		}
+		target -= w
+	}
+	front := clients[chosen]
+	copy(clients[1:chosen+1], clients[:chosen])
+	clients[0] = front
+}
+
+// orderClients arranges clients in the order in which they should be tried
+// according to the given ordering policy, using probe to tell healthy clients
+// apart as in splitHealthy. If randomizeTies is set, ties among the healthy
+// clients in orderClosest are broken at random. Randomness is drawn from rng,
+// or from the global source if rng is nil.
+func orderClients(ordering orderingPolicy, clients []batchClient,
+	probe func(addr string) bool, randomizeTies bool, rng *rand.Rand) error {
+	intn, float64Fn := rand.Intn, rand.Float64
+	if rng != nil {
+		intn, float64Fn = rng.Intn, rng.Float64
+	}
+	switch ordering {
+	case orderStable:
+	case orderRandom:
+		// Randomly permute order, but keep known-unhealthy clients last.
+		nHealthy, err := splitHealthy(clients, probe)
+		if err != nil {
+			return err
+		}
+		shuffleClients(clients[:nHealthy], intn)
+		shuffleClients(clients[nHealthy:], intn)
+	case orderWeightedRandom:
+		// Spread load by not always starting with the fastest client.
+		nHealthy, err := splitHealthy(clients, probe)
+		if err != nil {
+			return err
+		}
+		pickByInverseRTT(clients[:nHealthy], float64Fn)
+	case orderClosest:
+		healthy := make([]bool, len(clients))
+		rtts := make([]time.Duration, len(clients))
+		for i, client := range clients {
+			var err error
+			if healthy[i], err = isHealthy(client, probe); err != nil {
+				return err
+			}
+			rtts[i] = client.rtt
+		}
+		ordered := make([]batchClient, len(clients))
+		var nHealthy int
+		for i, j := range OrderByHealthAndRTT(healthy, rtts) {
+			ordered[i] = clients[j]
+			if healthy[j] {
+				nHealthy++
+			}
+		}
+		copy(clients, ordered)
+		if randomizeTies {
+			// The healthy clients are sorted by RTT, so ties are adjacent.
+			for start := 0; start < nHealthy; {
+				end := start + 1
+				for end < nHealthy && clients[end].rtt == clients[start].rtt {
+					end++
+				}
+				shuffleClients(clients[start:end], intn)
+				start = end
+			}
+		}
+	default:
+		return util.Errorf("unknown ordering policy %d", ordering)
+	}
+	return nil
 }
 
-func shuffleClients(clients []batchClient) {
+// excludeNodes returns the replicas which are not on the excluded nodes, or
+// all replicas if none remain. The input slice is not modified.
+func excludeNodes(replicas ReplicaSlice, excluded map[roachpb.NodeID]struct{}) ReplicaSlice {
+	var remaining ReplicaSlice
+	for _, replica := range replicas {
+		if _, ok := excluded[replica.NodeDesc.NodeID]; !ok {
+			remaining = append(remaining, replica)
+		}
+	}
+	if len(remaining) == 0 {
+		return replicas
+	}
+	return remaining
+}
+
+func shuffleClients(clients []batchClient, intn func(int) int) {
 	for i, n := 0, len(clients); i < n-1; i++ {
-		j := rand.Intn(n-i) + i
+		j := intn(n-i) + i
 		clients[i], clients[j] = clients[j], clients[i]
 	}
 }
 
 type batchCall struct {
-	reply *roachpb.BatchResponse
-	err   error
+	// remoteAddr is the address of the replica which produced the call.
+	remoteAddr string
+	reply      *roachpb.BatchResponse
+	err        error
+	// code is the gRPC status code of err; codes.OK if err is nil,
+	// codes.Unavailable for an rpcError, and codes.Unknown if err did not
+	// otherwise originate from gRPC.
+	code codes.Code
+	// local is set if the call was served by the local server rather than
+	// via RPC.
+	local bool
+	// retryable is set if err leaves the batch safe to send again: always
+	// for read-only batches, and for writes only if err is an rpcError,
+	// showing that the batch was never sent. It annotates the call for
+	// logging; whether send's error is retryable is decided by err alone.
+	retryable bool
+	// slow is set if the call took longer than SendOptions.SoftTimeout.
+	slow bool
+	// retries is the number of times a read-only batch was retried on a
+	// transient error; see SendOptions.ReadRetries.
+	retries int
+}
+
+// makeBatchCall returns a batchCall for the given reply and error received
+// from client, verifying the reply according to opts.VerificationMode and
+// opts.VerificationSampleRate.
+func makeBatchCall(opts SendOptions, client *batchClient,
+	reply *roachpb.BatchResponse, err error) batchCall {
+	if err == nil && reply != nil && reply.Error == nil && opts.VerificationMode != verifyOff {
+		if vErr := verifyReply(&client.args, reply, verificationSampler(opts)); vErr != nil {
+			if opts.VerificationMode == verifyFail {
+				reply, err = nil, vErr
+			} else {
+				log.Error(vErr)
+			}
+		}
+	}
+	code := grpc.Code(err)
+	_, notSent := err.(rpcError)
+	if notSent {
+		code = codes.Unavailable
+	}
+	return batchCall{
+		remoteAddr: client.remoteAddr,
+		reply:      reply,
+		err:        err,
+		code:       code,
+		retryable:  err != nil && (client.args.IsReadOnly() || notSent),
+	}
+}
+
+// isolateArgs returns a deep copy of args, made by a round trip through its
+// wire encoding as on the RPC path.
+func isolateArgs(args *roachpb.BatchRequest) (*roachpb.BatchRequest, error) {
+	data, err := args.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	argsCopy := &roachpb.BatchRequest{}
+	if err := argsCopy.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return argsCopy, nil
+}
+
+// A clientTimeoutError indicates that an RPC failed because its context
+// expired on the client, as opposed to, for example, the server giving up on
+// a deadline of its own.
+type clientTimeoutError struct {
+	addr string
+	err  error
+}
+
+// Error implements the error interface.
+func (e clientTimeoutError) Error() string {
+	return fmt.Sprintf("rpc to %s timed out on the client: %s", e.addr, e.err)
+}
+
+// clientTimeout returns call with its error wrapped in a clientTimeoutError
+// if the RPC failed after ctx, its context, expired. The gRPC code of the
+// original error is retained.
+func clientTimeout(ctx context.Context, call batchCall) batchCall {
+	if call.err != nil && ctx.Err() == context.DeadlineExceeded {
+		call.err = clientTimeoutError{addr: call.remoteAddr, err: call.err}
+	}
+	return call
+}
+
+// verificationSampler returns a function which, called once per response in
+// order, reports whether that response is to be verified according to
+// opts.VerificationSampleRate and opts.VerificationSeed.
+func verificationSampler(opts SendOptions) func() bool {
+	if opts.VerificationSampleRate <= 1 {
+		return func() bool { return true }
+	}
+	intn := rand.Intn
+	if opts.VerificationSeed != 0 {
+		intn = rand.New(rand.NewSource(opts.VerificationSeed)).Intn
+	}
+	return func() bool { return intn(opts.VerificationSampleRate) == 0 }
+}
+
+// verifyReply verifies the integrity of the responses in reply selected by
+// sample against the corresponding requests in args.
+func verifyReply(args *roachpb.BatchRequest, reply *roachpb.BatchResponse, sample func() bool) error {
+	if len(reply.Responses) != len(args.Requests) {
+		return util.Errorf("reply has %d responses for %d requests",
+			len(reply.Responses), len(args.Requests))
+	}
+	for i, ru := range reply.Responses {
+		if !sample() {
+			continue
+		}
+		if err := ru.GetInner().Verify(args.Requests[i].GetInner()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Send sends one or more RPCs to clients specified by the slice of
@@ -113,55 +630,149 @@ func send(opts SendOptions, replicas ReplicaSlice,
 				len(replicas), 1), false)
 	}
 
+	// Don't bother dialing and failing over through every replica if the
+	// caller has already given up.
+	if opts.Context != nil {
+		if err := opts.Context.Err(); err != nil {
+			sp.LogEvent(fmt.Sprintf("not sending: %s", err))
+			return nil, err
+		}
+	}
+
+	if len(opts.ExcludedNodes) > 0 {
+		replicas = excludeNodes(replicas, opts.ExcludedNodes)
+	}
+
 	done := make(chan batchCall, len(replicas))
 
-	clients := make([]batchClient, 0, len(replicas))
+	clientsPtr := batchClientsPool.Get().(*[]batchClient)
+	clients := (*clientsPtr)[:0]
+	defer func() { putBatchClients(clientsPtr, clients) }()
+	latencies := opts.LatencySource
+	if latencies == nil {
+		latencies = rpcContext.RemoteClocks
+	}
+	seen := make(map[string]struct{}, len(replicas))
 	for _, replica := range replicas {
-		conn, err := rpcContext.GRPCDial(replica.NodeDesc.Address.String())
+		addr := replica.NodeDesc.Address.String()
+		// Replicas may briefly share an address during membership changes;
+		// failing over to the same node again is pointless.
+		if _, ok := seen[addr]; ok {
+			log.Warningf("skipping replica on store %d: duplicate address %s", replica.StoreID, addr)
+			continue
+		}
+		seen[addr] = struct{}{}
+		conn, err := rpcContext.GRPCDial(addr)
 		if err != nil {
 			return nil, err
 		}
 		argsCopy := args
 		argsCopy.Replica = replica.ReplicaDescriptor
+		rtt, _ := latencies.Latency(addr)
 		clients = append(clients, batchClient{
-			remoteAddr: replica.NodeDesc.Address.String(),
+			remoteAddr: addr,
 			conn:       conn,
 			client:     roachpb.NewInternalClient(conn),
 			args:       argsCopy,
+			rtt:        rtt,
 		})
 	}
 
-	var orderedClients []batchClient
-	switch opts.Ordering {
-	case orderStable:
-		orderedClients = clients
-	case orderRandom:
-		// Randomly permute order, but keep known-unhealthy clients last.
+	if opts.MinHealthyReplicas > 0 {
 		var nHealthy int
-		for i, client := range clients {
-			clientState, err := client.conn.State()
+		for _, client := range clients {
+			healthy, err := isHealthy(client, opts.HealthProbe)
 			if err != nil {
 				return nil, err
 			}
-			if clientState == grpc.Ready {
-				clients[i], clients[nHealthy] = clients[nHealthy], clients[i]
+			if healthy {
 				nHealthy++
 			}
 		}
+		if nHealthy < opts.MinHealthyReplicas {
+			return nil, insufficientHealthyReplicasError{healthy: nHealthy, required: opts.MinHealthyReplicas}
+		}
+	}
+
+	if err := orderClients(opts.Ordering, clients, opts.HealthProbe, opts.RandomizeTies, opts.Rand); err != nil {
+		return nil, err
+	}
+	orderedClients := clients
+	if opts.SkipUnhealthy {
+		nHealthy, err := splitHealthy(orderedClients, opts.HealthProbe)
+		if err != nil {
+			return nil, err
+		}
+		if nHealthy > 0 {
+			orderedClients = orderedClients[:nHealthy]
+		}
+	}
+	// numClients is the number of clients which may be sent to.
+	numClients := len(orderedClients)
 
-		shuffleClients(clients[:nHealthy])
-		shuffleClients(clients[nHealthy:])
+	// Attempts still in flight when send returns are losers to a reply that
+	// has already been accepted (or there are none); cancel them so that they
+	// stop consuming resources on their replicas.
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+	var cancel func()
+	opts.Context, cancel = context.WithCancel(opts.Context)
+	defer cancel()
 
-		orderedClients = clients
+	deadlineExceeded := func() bool {
+		return !opts.OverallDeadline.IsZero() && !time.Now().Before(opts.OverallDeadline)
+	}
+
+	var pending int
+	// inflight counts the outstanding attempts per address, so that a reply
+	// without a matching attempt, which indicates a bug, is reported.
+	inflight := make(map[string]int, len(clients))
+	// lastAddr is the address most recently sent to, and cancelLast cancels
+	// that attempt when opts.CancelPreviousAttempt is set.
+	var lastAddr string
+	var cancelLast func()
+	// degraded is set if the replica most recently sent to was unhealthy.
+	// It is only tracked if opts.DegradedSendNextTimeout is set.
+	var degraded bool
+	// sendNext sends to the next client and returns its address. Unless the
+	// ordering is stable, clients whose connections have become unhealthy
+	// since they were ordered are first moved behind the healthy ones.
+	sendNext := func() string {
+		// The first attempt goes out right after the clients were ordered.
+		if opts.Ordering != orderStable && len(orderedClients) < numClients {
+			if _, err := splitHealthy(orderedClients, opts.HealthProbe); err != nil {
+				log.Warningf("unable to refresh replica health: %s", err)
+			}
+		}
+		client := orderedClients[0]
+		if opts.DegradedSendNextTimeout != 0 {
+			healthy, err := isHealthy(client, opts.HealthProbe)
+			degraded = err == nil && !healthy
+			if degraded {
+				sp.LogEvent(fmt.Sprintf("degraded: sending to unhealthy replica %s", client.remoteAddr))
+			}
+		}
+		if opts.RewriteForAttempt != nil {
+			opts.RewriteForAttempt(numClients-len(orderedClients)+1, &client.args)
+		}
+		attemptOpts := opts
+		if opts.CancelPreviousAttempt {
+			if cancelLast != nil {
+				cancelLast()
+			}
+			attemptOpts.Context, cancelLast = context.WithCancel(opts.Context)
+		}
+		sendOneFn(attemptOpts, rpcContext, client, done)
+		orderedClients = orderedClients[1:]
+		pending++
+		inflight[client.remoteAddr]++
+		lastAddr = client.remoteAddr
+		return client.remoteAddr
 	}
-	// TODO(spencer): going to need to also sort by affinity; closest
-	// ping time should win. Makes sense to have the rpc client/server
-	// heartbeat measure ping times. With a bit of seasoning, each
-	// node will be able to order the healthy replicas based on latency.
 
 	// Send the first request.
-	sendOneFn(orderedClients[0], opts.Timeout, rpcContext, sp, done)
-	orderedClients = orderedClients[1:]
+	sendNext()
 
 	var errors, retryableErrors int
 
@@ -169,18 +780,40 @@ func send(opts SendOptions, replicas ReplicaSlice,
 	var sendNextTimer util.Timer
 	defer sendNextTimer.Stop()
 	for {
-		sendNextTimer.Reset(opts.SendNextTimeout)
+		sendNextTimeout := opts.SendNextTimeout
+		if degraded {
+			sendNextTimeout = opts.DegradedSendNextTimeout
+		}
+		sendNextTimer.Reset(sendNextTimeout)
 		select {
 		case <-sendNextTimer.C:
 			sendNextTimer.Read = true
 			// On successive RPC timeouts, send to additional replicas if available.
-			if len(orderedClients) > 0 {
+			if len(orderedClients) > 0 && !deadlineExceeded() {
 				sp.LogEvent("timeout, trying next peer")
-				sendOneFn(orderedClients[0], opts.Timeout, rpcContext, sp, done)
-				orderedClients = orderedClients[1:]
+				sendNext()
 			}
 
 		case call := <-done:
+			if inflight[call.remoteAddr] > 0 {
+				inflight[call.remoteAddr]--
+			} else {
+				// Ignoring the reply could leave send waiting forever for
+				// one which never comes, so it is counted against the
+				// attempts in flight instead.
+				log.Errorf("reply from %s without a matching attempt: %v",
+					call.remoteAddr, call.err)
+				sp.LogEvent(fmt.Sprintf("unexpected reply from %s", call.remoteAddr))
+			}
+			if pending > 0 {
+				pending--
+			}
+			if call.slow {
+				sp.LogEvent(slowRPCEvent(call.remoteAddr, opts.SoftTimeout))
+			}
+			if call.retries > 0 {
+				sp.LogEvent(fmt.Sprintf("retried read on %s %d times", call.remoteAddr, call.retries))
+			}
 			err := call.err
 			if err == nil {
 				if log.V(2) {
@@ -192,7 +825,7 @@ func send(opts SendOptions, replicas ReplicaSlice,
 
 			// Error handling.
 			if log.V(1) {
-				log.Warningf("error reply: %s", err)
+				log.Warningf("error reply (%s, retryable=%t): %s", call.code, call.retryable, err)
 			}
 
 			errors++
@@ -203,21 +836,159 @@ func send(opts SendOptions, replicas ReplicaSlice,
 				retryableErrors++
 			}
 
-			if remainingNonErrorRPCs := len(replicas) - errors; remainingNonErrorRPCs < 1 {
+			if remainingNonErrorRPCs := numClients - errors; remainingNonErrorRPCs < 1 {
 				return nil, roachpb.NewSendError(
 					fmt.Sprintf("too many errors encountered (%d of %d total): %v",
-						errors, len(clients), err), remainingNonErrorRPCs+retryableErrors >= 1)
+						errors, numClients, err), remainingNonErrorRPCs+retryableErrors >= 1)
+			}
+			if opts.CancelPreviousAttempt && call.remoteAddr != lastAddr {
+				// This attempt was cancelled in favor of a later one, which
+				// is still in flight; failing over would cancel that too.
+				continue
+			}
+			if deadlineExceeded() {
+				// Don't try further replicas, but wait for outstanding RPCs,
+				// which are bound by the deadline as well.
+				if pending == 0 {
+					return nil, roachpb.NewSendError(
+						fmt.Sprintf("overall deadline exceeded after %d of %d replicas failed: %v",
+							errors, numClients, err), true)
+				}
+				continue
 			}
 			// Send to additional replicas if available.
 			if len(orderedClients) > 0 {
-				sp.LogEvent("error, trying next peer")
-				sendOneFn(orderedClients[0], opts.Timeout, rpcContext, sp, done)
-				orderedClients = orderedClients[1:]
+				to := sendNext()
+				attempt := numClients - len(orderedClients)
+				event := failoverEvent(call.remoteAddr, to, err, attempt)
+				if log.V(1) {
+					log.Info(event)
+				}
+				sp.LogEvent(event)
 			}
 		}
 	}
 }
 
+// ProbeReplica reports whether the KV subsystem serving replica of the given
+// range is responsive, by sending it a batch holding a single NoopRequest,
+// which reads and writes no data. It returns the time taken for the batch to
+// be answered, or the error if it failed. opts is used as for send.
+func ProbeReplica(opts SendOptions, rangeID roachpb.RangeID, replica ReplicaInfo,
+	rpcContext *rpc.Context) (time.Duration, error) {
+	var ba roachpb.BatchRequest
+	ba.RangeID = rangeID
+	// The probe must not depend on the replica holding the leader lease.
+	ba.ReadConsistency = roachpb.INCONSISTENT
+	ba.Add(&roachpb.NoopRequest{})
+
+	start := time.Now()
+	reply, err := send(opts, ReplicaSlice{replica}, ba, rpcContext)
+	if err == nil && reply.Error != nil {
+		err = reply.Error.GoError()
+	}
+	return time.Since(start), err
+}
+
+// failoverEvent describes a failover from the replica at from, which failed
+// with err, to the replica at to, which receives the given attempt (counting
+// from one).
+func failoverEvent(from, to string, err error, attempt int) string {
+	return fmt.Sprintf("failover: attempt=%d from=%s to=%s error=%q", attempt, from, to, err)
+}
+
+// isTransientError returns whether err is a transient connection error after
+// which retrying on the same connection is likely to succeed.
+func isTransientError(err error) bool {
+	return err == io.ErrUnexpectedEOF || grpc.Code(err) == codes.Unavailable
+}
+
+// startSoftTimer starts a timer which logs a warning once the RPC to addr has
+// been outstanding for softTimeout, unless softTimeout is zero. The returned
+// function stops the timer and reports whether it fired.
+func startSoftTimer(addr string, softTimeout time.Duration) func() bool {
+	if softTimeout == 0 {
+		return func() bool { return false }
+	}
+	timer := time.AfterFunc(softTimeout, func() {
+		log.Warning(slowRPCEvent(addr, softTimeout))
+	})
+	return func() bool { return !timer.Stop() }
+}
+
+// slowRPCEvent describes an RPC to addr which has exceeded the soft timeout.
+func slowRPCEvent(addr string, softTimeout time.Duration) string {
+	return fmt.Sprintf("rpc to %s still outstanding after %s", addr, softTimeout)
+}
+
+// priorityMetadataKey is the gRPC metadata key carrying the user priority of
+// a batch, for servers and intermediaries which apply QoS.
+const priorityMetadataKey = "cockroach-priority"
+
+// budgetMetadataKey is the gRPC metadata key carrying the milliseconds left
+// until the deadline of an RPC, for servers which shed load they cannot
+// finish in time.
+const budgetMetadataKey = "cockroach-budget-ms"
+
+// requestMetadata returns the gRPC metadata to send along with args in an
+// RPC with context ctx. It is empty if neither carries anything worth
+// advertising.
+func requestMetadata(ctx context.Context, args *roachpb.BatchRequest) metadata.MD {
+	md := metadata.MD{}
+	if deadline, ok := ctx.Deadline(); ok {
+		budget := deadline.Sub(time.Now())
+		if budget < 0 {
+			budget = 0
+		}
+		md[budgetMetadataKey] = []string{strconv.FormatInt(int64(budget/time.Millisecond), 10)}
+	}
+	if args.UserPriority != 0 {
+		md[priorityMetadataKey] = []string{
+			strconv.FormatFloat(float64(args.UserPriority), 'g', -1, 64),
+		}
+	}
+	return md
+}
+
+// withRequestMetadata returns ctx with the metadata of requestMetadata added
+// to any metadata ctx already carries.
+func withRequestMetadata(ctx context.Context, args *roachpb.BatchRequest) context.Context {
+	md := requestMetadata(ctx, args)
+	if len(md) == 0 {
+		return ctx
+	}
+	if existing, ok := metadata.FromContext(ctx); ok {
+		for k, v := range existing {
+			if _, ok := md[k]; !ok {
+				md[k] = v
+			}
+		}
+	}
+	return metadata.NewContext(ctx, md)
+}
+
+// readRetryOptions govern the backoff between retries of a read-only batch
+// on a transient error; see SendOptions.ReadRetries.
+var readRetryOptions = retry.Options{
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     100 * time.Millisecond,
+	Multiplier:     2,
+}
+
+// waitForReady blocks until conn is ready, returning an rpcError if it shuts
+// down or ctx is done first.
+func waitForReady(ctx context.Context, addr string, conn *grpc.ClientConn) error {
+	for state, err := conn.State(); state != grpc.Ready; state, err = conn.WaitForStateChange(ctx, state) {
+		if err != nil {
+			return newRPCError(util.Errorf("rpc to %s failed: %s", addr, err))
+		}
+		if state == grpc.Shutdown {
+			return newRPCError(util.Errorf("rpc to %s failed as client connection was closed", addr))
+		}
+	}
+	return nil
+}
+
 // Allow local calls to be dispatched directly to the local server without
 // sending an RPC.
 var enableLocalCalls = os.Getenv("ENABLE_LOCAL_CALLS") != "0"
@@ -231,42 +1002,129 @@ var sendOneFn = sendOne
 //
 // Do not call directly, but instead use sendOneFn. Tests mock out this method
 // via sendOneFn in order to test various error cases.
-func sendOne(client batchClient, timeout time.Duration,
-	rpcContext *rpc.Context, trace opentracing.Span, done chan batchCall) {
+func sendOne(opts SendOptions, rpcContext *rpc.Context, client batchClient, done chan batchCall) {
 	addr := client.remoteAddr
+	trace := opts.Trace
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// cancel releases the contexts derived for the call, and their timers.
+	cancel := func() {}
+	if !opts.OverallDeadline.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, opts.OverallDeadline)
+	}
+
+	// Every result is delivered through finish, which stops the soft timer
+	// and cancels the call's contexts. The timer never touches the trace,
+	// which may be finished by the time it fires.
+	stopSoftTimer := startSoftTimer(addr, opts.SoftTimeout)
+	finish := func(call batchCall) {
+		call.slow = stopSoftTimer()
+		done <- call
+		cancel()
+	}
+	// Don't bother dispatching if the caller has already given up.
+	if err := ctx.Err(); err != nil {
+		trace.LogEvent(fmt.Sprintf("not sending to %s: %s", addr, err))
+		finish(makeBatchCall(opts, &client, nil, err))
+		return
+	}
+
 	if log.V(2) {
 		log.Infof("sending request to %s: %+v", addr, client.args)
 	}
 	trace.LogEvent(fmt.Sprintf("sending to %s", addr))
+	if opts.OnDispatch != nil {
+		opts.OnDispatch(addr, client.args)
+	}
 
-	// TODO(tamird/tschottdorf): pass this in from DistSender.
-	ctx := context.TODO()
-	if timeout != 0 {
-		ctx, _ = context.WithTimeout(ctx, timeout)
+	if opts.Timeout != 0 {
+		var cancelTimeout func()
+		ctx, cancelTimeout = context.WithTimeout(ctx, opts.Timeout)
+		cancelDeadline := cancel
+		cancel = func() {
+			cancelTimeout()
+			cancelDeadline()
+		}
 	}
+	ctx = context.WithValue(ctx, replicaKey{}, client.args.Replica)
+	ctx = context.WithValue(ctx, remoteAddrKey{}, addr)
 
-	if localServer := rpcContext.GetLocalInternalServerForAddr(addr); enableLocalCalls && localServer != nil {
-		reply, err := localServer.Batch(ctx, &client.args)
-		done <- batchCall{reply: reply, err: err}
-		return
+	if localServer := rpcContext.GetLocalInternalServerForAddr(addr); enableLocalCalls &&
+		!opts.DisableLocalCalls && localServer != nil {
+		args := &client.args
+		var err error
+		if opts.IsolateLocalArgs {
+			args, err = isolateArgs(args)
+		}
+		var reply *roachpb.BatchResponse
+		if err == nil {
+			batch := chainInterceptors(opts.Interceptors,
+				func(ctx context.Context, args *roachpb.BatchRequest) (*roachpb.BatchResponse, error) {
+					return localServer.Batch(withRequestMetadata(ctx, args), args)
+				})
+			reply, err = batch(ctx, args)
+		}
+		if err == nil || !opts.FallbackLocalToRemote {
+			call := clientTimeout(ctx, makeBatchCall(opts, &client, reply, err))
+			call.local = true
+			finish(call)
+			return
+		}
+		if log.V(1) {
+			log.Warningf("local call to %s failed, falling back to RPC: %s", addr, err)
+		}
+		trace.LogEvent(fmt.Sprintf("local call failed, sending RPC to %s", addr))
 	}
 
 	go func() {
-		c := client.conn
-		for state, err := c.State(); state != grpc.Ready; state, err = c.WaitForStateChange(ctx, state) {
-			if err != nil {
-				done <- batchCall{err: newRPCError(
-					util.Errorf("rpc to %s failed: %s", addr, err))}
-				return
-			}
-			if state == grpc.Shutdown {
-				done <- batchCall{err: newRPCError(
-					util.Errorf("rpc to %s failed as client connection was closed", addr))}
-				return
-			}
+		if err := waitForReady(ctx, addr, client.conn); err != nil {
+			finish(makeBatchCall(opts, &client, nil, err))
+			return
 		}
 
-		reply, err := client.client.Batch(ctx, &client.args)
-		done <- batchCall{reply: reply, err: err}
+		// The semaphore slot is held for each call only, not while backing
+		// off between retries. The metadata is computed after any waiting, so
+		// that the budget it advertises is current.
+		batch := chainInterceptors(opts.Interceptors,
+			func(ctx context.Context, args *roachpb.BatchRequest) (*roachpb.BatchResponse, error) {
+				if opts.Semaphore != nil {
+					select {
+					case opts.Semaphore <- struct{}{}:
+						defer func() { <-opts.Semaphore }()
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					}
+				}
+				return client.client.Batch(withRequestMetadata(ctx, args), args)
+			})
+		reply, err := batch(ctx, &client.args)
+		var retries int
+		if client.args.IsReadOnly() && opts.ReadRetries > 0 && isTransientError(err) {
+			retryOpts := readRetryOptions
+			retryOpts.MaxRetries = opts.ReadRetries
+			retryOpts.Closer = ctx.Done()
+			r := retry.Start(retryOpts)
+			// The first call to Next returns immediately, standing for the
+			// attempt already made.
+			r.Next()
+			for isTransientError(err) && r.Next() {
+				// The trace is left to send, which may have returned by now.
+				if log.V(1) {
+					log.Warningf("retrying read on %s after transient error: %s", addr, err)
+				}
+				// The connection may have dropped along with the RPC.
+				if err = waitForReady(ctx, addr, client.conn); err != nil {
+					break
+				}
+				retries++
+				reply, err = batch(ctx, &client.args)
+			}
+		}
+		call := clientTimeout(ctx, makeBatchCall(opts, &client, reply, err))
+		call.retries = retries
+		finish(call)
 	}()
 }
@@ -18,13 +18,23 @@ package kv
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	basictracer "github.com/opentracing/basictracer-go"
 	opentracing "github.com/opentracing/opentracing-go"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/cockroachdb/cockroach/roachpb"
 	"github.com/cockroachdb/cockroach/rpc"
@@ -66,6 +76,71 @@ func (n Node) Batch(ctx context.Context, args *roachpb.BatchRequest) (*roachpb.B
 	return &roachpb.BatchResponse{}, nil
 }
 
+// errNode is an InternalServer which fails every batch with err.
+type errNode struct {
+	err error
+}
+
+func (n errNode) Batch(ctx context.Context, args *roachpb.BatchRequest) (*roachpb.BatchResponse, error) {
+	return nil, n.err
+}
+
+// replyErrNode is an InternalServer which, like server.Node, fails every batch
+// by returning a reply carrying err.
+type replyErrNode struct {
+	err error
+}
+
+func (n replyErrNode) Batch(ctx context.Context, args *roachpb.BatchRequest) (*roachpb.BatchResponse, error) {
+	br := &roachpb.BatchResponse{}
+	br.Error = roachpb.NewError(n.err)
+	return br, nil
+}
+
+// txnRenamingNode is an InternalServer which renames the transaction of each
+// batch it serves.
+type txnRenamingNode struct{}
+
+func (txnRenamingNode) Batch(ctx context.Context, args *roachpb.BatchRequest) (*roachpb.BatchResponse, error) {
+	args.Txn.Name = "renamed"
+	return &roachpb.BatchResponse{}, nil
+}
+
+// fakeInternalClient is an InternalClient which hands each batch to the
+// wrapped function.
+type fakeInternalClient func(context.Context, *roachpb.BatchRequest, ...grpc.CallOption) (*roachpb.BatchResponse, error)
+
+func (f fakeInternalClient) Batch(ctx context.Context, args *roachpb.BatchRequest,
+	opts ...grpc.CallOption) (*roachpb.BatchResponse, error) {
+	return f(ctx, args, opts...)
+}
+
+// newReadyConn starts a server and returns a client connection to it, along
+// with its address, once the connection is ready.
+func newReadyConn(t *testing.T, ctx *rpc.Context) (*grpc.ClientConn, string) {
+	_, ln := newTestServer(t, ctx)
+	conn, err := ctx.GRPCDial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForConnState(t, conn, grpc.Ready)
+	return conn, ln.Addr().String()
+}
+
+// waitForConnState blocks until conn reaches the desired state.
+func waitForConnState(t *testing.T, conn *grpc.ClientConn, desiredState grpc.ConnectivityState) {
+	state, err := conn.State()
+	for state != desiredState {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state == grpc.Shutdown {
+			t.Fatalf("%v has unexpectedly shut down", conn)
+		}
+		state, err = conn.WaitForStateChange(context.Background(), state)
+	}
+}
+
 func TestInvalidAddrLength(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
@@ -112,6 +187,330 @@ func TestSendToOneClient(t *testing.T) {
 	}
 }
 
+// TestOnDispatch verifies that OnDispatch observes each batch, and the replica
+// it is sent to, in the order the replicas are tried.
+func TestOnDispatch(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	ctx := newNodeTestContext(nil, stopper)
+	s1, ln1 := newTestServer(t, ctx)
+	roachpb.RegisterInternalServer(s1, errNode{errors.New("failure")})
+	s2, ln2 := newTestServer(t, ctx)
+	roachpb.RegisterInternalServer(s2, Node(0))
+
+	type dispatch struct {
+		addr string
+		args roachpb.BatchRequest
+	}
+	var dispatched []dispatch
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{
+		Ordering:        orderStable,
+		SendNextTimeout: 1 * time.Second,
+		Timeout:         10 * time.Second,
+		Trace:           sp,
+		OnDispatch: func(addr string, args roachpb.BatchRequest) {
+			dispatched = append(dispatched, dispatch{addr, args})
+		},
+	}
+	var args roachpb.BatchRequest
+	args.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("a")}})
+	if _, err := send(opts, makeReplicas(ln1.Addr(), ln2.Addr()), args, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []dispatch{{ln1.Addr().String(), args}, {ln2.Addr().String(), args}}
+	if !reflect.DeepEqual(dispatched, expected) {
+		t.Errorf("expected dispatches %+v, got %+v", expected, dispatched)
+	}
+}
+
+// TestFallbackLocalToRemote verifies that a local call returning an error is
+// retried via RPC only when FallbackLocalToRemote is set, and that a reply
+// carrying an error, as returned by Node.Batch, never is.
+func TestFallbackLocalToRemote(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	defer func(prev bool) { enableLocalCalls = prev }(enableLocalCalls)
+	enableLocalCalls = true
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	ctx := newNodeTestContext(nil, stopper)
+	s, ln := newTestServer(t, ctx)
+	roachpb.RegisterInternalServer(s, Node(0))
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+
+	localErr := errors.New("local replica unavailable")
+	testCases := []struct {
+		local       roachpb.InternalServer
+		expFallback bool
+	}{
+		{errNode{localErr}, true},
+		{replyErrNode{localErr}, false},
+	}
+	for _, test := range testCases {
+		local := test.local
+		ctx.SetLocalInternalServer(local, ln.Addr().String())
+		for _, fallback := range []bool{false, true} {
+			opts := SendOptions{
+				Ordering:              orderStable,
+				SendNextTimeout:       1 * time.Second,
+				Timeout:               10 * time.Second,
+				Trace:                 sp,
+				FallbackLocalToRemote: fallback,
+			}
+			reply, err := sendBatch(opts, []net.Addr{ln.Addr()}, ctx)
+			if err == nil && reply.Error != nil {
+				err = reply.Error.GoError()
+			}
+			if fallback && test.expFallback {
+				if err != nil {
+					t.Fatalf("%T fallback: unexpected error: %s", local, err)
+				}
+				if reply == nil {
+					t.Errorf("%T fallback: expected reply", local)
+				}
+			} else if !testutils.IsError(err, "local replica unavailable") {
+				t.Errorf("%T fallback=%t: expected local error, got %v", local, fallback, err)
+			}
+		}
+	}
+}
+
+// TestDisableLocalCalls verifies that DisableLocalCalls bypasses the local
+// server in favor of an RPC.
+func TestDisableLocalCalls(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	defer func(prev bool) { enableLocalCalls = prev }(enableLocalCalls)
+	enableLocalCalls = true
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	ctx := newNodeTestContext(nil, stopper)
+	s, ln := newTestServer(t, ctx)
+	roachpb.RegisterInternalServer(s, Node(0))
+	ctx.SetLocalInternalServer(errNode{errors.New("local call")}, ln.Addr().String())
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+
+	opts := SendOptions{
+		Ordering:          orderStable,
+		SendNextTimeout:   1 * time.Second,
+		Timeout:           10 * time.Second,
+		Trace:             sp,
+		DisableLocalCalls: true,
+	}
+	if _, err := sendBatch(opts, []net.Addr{ln.Addr()}, ctx); err != nil {
+		t.Fatalf("expected the RPC to succeed, got %v", err)
+	}
+
+	opts.DisableLocalCalls = false
+	if _, err := sendBatch(opts, []net.Addr{ln.Addr()}, ctx); !testutils.IsError(err, "local call") {
+		t.Fatalf("expected the local call to fail, got %v", err)
+	}
+}
+
+// TestLocalCallFlag verifies that calls are flagged as local only when served
+// by the local server.
+func TestLocalCallFlag(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	defer func(prev bool) { enableLocalCalls = prev }(enableLocalCalls)
+	enableLocalCalls = true
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	localConn, localAddr := newReadyConn(t, nodeContext)
+	remoteConn, remoteAddr := newReadyConn(t, nodeContext)
+	nodeContext.SetLocalInternalServer(Node(0), localAddr)
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{Trace: sp}
+
+	reply := fakeInternalClient(func(context.Context, *roachpb.BatchRequest,
+		...grpc.CallOption) (*roachpb.BatchResponse, error) {
+		return &roachpb.BatchResponse{}, nil
+	})
+	testCases := []struct {
+		client   batchClient
+		expLocal bool
+	}{
+		{batchClient{remoteAddr: localAddr, conn: localConn, client: reply}, true},
+		{batchClient{remoteAddr: remoteAddr, conn: remoteConn, client: reply}, false},
+	}
+	for i, test := range testCases {
+		done := make(chan batchCall, 1)
+		sendOne(opts, nodeContext, test.client, done)
+		call := <-done
+		if call.err != nil {
+			t.Fatalf("%d: %s", i, call.err)
+		}
+		if call.local != test.expLocal {
+			t.Errorf("%d: expected local=%t, got %t", i, test.expLocal, call.local)
+		}
+	}
+}
+
+// TestIsolateLocalArgs verifies that the local server cannot modify the
+// caller's batch when IsolateLocalArgs is set.
+func TestIsolateLocalArgs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	defer func(prev bool) { enableLocalCalls = prev }(enableLocalCalls)
+	enableLocalCalls = true
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	conn, addr := newReadyConn(t, nodeContext)
+	nodeContext.SetLocalInternalServer(txnRenamingNode{}, addr)
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+
+	for _, isolate := range []bool{false, true} {
+		txn := &roachpb.Transaction{Name: "original"}
+		client := batchClient{remoteAddr: addr, conn: conn}
+		client.args.Txn = txn
+		opts := SendOptions{Trace: sp, IsolateLocalArgs: isolate}
+		done := make(chan batchCall, 1)
+		sendOne(opts, nodeContext, client, done)
+		if call := <-done; call.err != nil {
+			t.Fatal(call.err)
+		}
+		if renamed := txn.Name != "original"; renamed == isolate {
+			t.Errorf("isolate %t: unexpected transaction name %q", isolate, txn.Name)
+		}
+	}
+}
+
+// TestInterceptors verifies that interceptors wrap the dispatch, in order, on
+// both the local and the RPC path.
+func TestInterceptors(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	defer func(prev bool) { enableLocalCalls = prev }(enableLocalCalls)
+	enableLocalCalls = true
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	localConn, localAddr := newReadyConn(t, nodeContext)
+	remoteConn, remoteAddr := newReadyConn(t, nodeContext)
+	nodeContext.SetLocalInternalServer(Node(0), localAddr)
+
+	var trail []string
+	record := func(name string) BatchInterceptor {
+		return func(ctx context.Context, args *roachpb.BatchRequest,
+			next BatchHandler) (*roachpb.BatchResponse, error) {
+			trail = append(trail, name+" before")
+			defer func() { trail = append(trail, name+" after") }()
+			return next(ctx, args)
+		}
+	}
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{
+		Trace:        sp,
+		Interceptors: []BatchInterceptor{record("outer"), record("inner")},
+	}
+
+	reply := fakeInternalClient(func(context.Context, *roachpb.BatchRequest,
+		...grpc.CallOption) (*roachpb.BatchResponse, error) {
+		trail = append(trail, "rpc")
+		return &roachpb.BatchResponse{}, nil
+	})
+	for _, client := range []batchClient{
+		{remoteAddr: localAddr, conn: localConn, client: reply},
+		{remoteAddr: remoteAddr, conn: remoteConn, client: reply},
+	} {
+		trail = nil
+		done := make(chan batchCall, 1)
+		sendOne(opts, nodeContext, client, done)
+		if call := <-done; call.err != nil {
+			t.Fatal(call.err)
+		}
+
+		expected := []string{"outer before", "inner before", "inner after", "outer after"}
+		if client.remoteAddr == remoteAddr {
+			expected = []string{"outer before", "inner before", "rpc", "inner after", "outer after"}
+		}
+		if !reflect.DeepEqual(trail, expected) {
+			t.Errorf("%s: expected %v, got %v", client.remoteAddr, expected, trail)
+		}
+	}
+}
+
+// TestReplicaFromContext verifies that interceptors can tell from the context
+// which replica an RPC targets.
+func TestReplicaFromContext(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	conn, addr := newReadyConn(t, nodeContext)
+
+	replica := roachpb.ReplicaDescriptor{NodeID: 1, StoreID: 2, ReplicaID: 3}
+	var seenReplica roachpb.ReplicaDescriptor
+	var seenAddr string
+	interceptor := func(ctx context.Context, args *roachpb.BatchRequest,
+		next BatchHandler) (*roachpb.BatchResponse, error) {
+		var ok bool
+		if seenReplica, ok = ReplicaFromContext(ctx); !ok {
+			t.Error("no replica in context")
+		}
+		if seenAddr, ok = RemoteAddrFromContext(ctx); !ok {
+			t.Error("no address in context")
+		}
+		return next(ctx, args)
+	}
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{Trace: sp, Interceptors: []BatchInterceptor{interceptor}}
+	client := batchClient{
+		remoteAddr: addr,
+		conn:       conn,
+		client: fakeInternalClient(func(context.Context, *roachpb.BatchRequest,
+			...grpc.CallOption) (*roachpb.BatchResponse, error) {
+			return &roachpb.BatchResponse{}, nil
+		}),
+	}
+	client.args.Replica = replica
+	done := make(chan batchCall, 1)
+	sendOne(opts, nodeContext, client, done)
+	if call := <-done; call.err != nil {
+		t.Fatal(call.err)
+	}
+
+	if !reflect.DeepEqual(seenReplica, replica) {
+		t.Errorf("expected replica %+v, got %+v", replica, seenReplica)
+	}
+	if seenAddr != addr {
+		t.Errorf("expected address %s, got %s", addr, seenAddr)
+	}
+}
+
 // TestRetryableError verifies that Send returns a retryable error
 // when it hits an RPC error.
 func TestRetryableError(t *testing.T) {
@@ -193,11 +592,11 @@ func TestUnretryableError(t *testing.T) {
 		Trace:           sp,
 	}
 
-	sendOneFn = func(_ batchClient, _ time.Duration,
-		_ *rpc.Context, _ opentracing.Span, done chan batchCall) {
+	sendOneFn = func(_ SendOptions, _ *rpc.Context, client batchClient, done chan batchCall) {
 		done <- batchCall{
-			reply: &roachpb.BatchResponse{},
-			err:   errors.New("unretryable"),
+			remoteAddr: client.remoteAddr,
+			reply:      &roachpb.BatchResponse{},
+			err:        errors.New("unretryable"),
 		}
 	}
 	defer func() { sendOneFn = sendOne }()
@@ -360,8 +759,7 @@ func TestComplexScenarios(t *testing.T) {
 		}
 
 		// Mock sendOne.
-		sendOneFn = func(client batchClient, _ time.Duration,
-			_ *rpc.Context, _ opentracing.Span, done chan batchCall) {
+		sendOneFn = func(_ SendOptions, _ *rpc.Context, client batchClient, done chan batchCall) {
 			addrID := -1
 			for serverAddrID, serverAddr := range serverAddrs {
 				if serverAddr.String() == client.remoteAddr {
@@ -373,7 +771,8 @@ func TestComplexScenarios(t *testing.T) {
 				t.Fatalf("%d: %s is not found in serverAddrs: %v", i, client.remoteAddr, serverAddrs)
 			}
 			call := batchCall{
-				reply: &roachpb.BatchResponse{},
+				remoteAddr: client.remoteAddr,
+				reply:      &roachpb.BatchResponse{},
 			}
 			if addrID < numErrors {
 				call.err = roachpb.NewSendError("test", addrID < numRetryableErrors)
@@ -400,14 +799,1995 @@ func TestComplexScenarios(t *testing.T) {
 	}
 }
 
-func makeReplicas(addrs ...net.Addr) ReplicaSlice {
-	replicas := make(ReplicaSlice, len(addrs))
-	for i, addr := range addrs {
-		replicas[i].NodeDesc = &roachpb.NodeDescriptor{
-			Address: util.MakeUnresolvedAddr(addr.Network(), addr.String()),
+// TestVerificationMode verifies that a corrupt reply is returned, logged or
+// turned into an error depending on the verification mode.
+func TestVerificationMode(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var args roachpb.BatchRequest
+	args.Add(roachpb.NewGet(roachpb.Key("a")))
+	// Checksum the value for the wrong key so that verification fails.
+	value := roachpb.MakeValueFromString("value")
+	value.InitChecksum(roachpb.Key("b"))
+	corrupt := &roachpb.BatchResponse{}
+	corrupt.Add(&roachpb.GetResponse{Value: &value})
+
+	testCases := []struct {
+		mode   verificationMode
+		expErr bool
+	}{
+		{verifyOff, false},
+		{verifyLog, false},
+		{verifyFail, true},
+	}
+	for i, test := range testCases {
+		call := makeBatchCall(SendOptions{VerificationMode: test.mode}, &batchClient{args: args}, corrupt, nil)
+		if test.expErr {
+			if !testutils.IsError(call.err, "invalid checksum") {
+				t.Errorf("%d: expected checksum error, got %v", i, call.err)
+			}
+			if call.reply != nil {
+				t.Errorf("%d: expected reply to be dropped", i)
+			}
+		} else if call.err != nil || call.reply != corrupt {
+			t.Errorf("%d: expected reply to be returned, got %+v", i, call)
 		}
 	}
-	return replicas
+}
+
+// TestVerificationSampleRate verifies that only about one in
+// VerificationSampleRate responses is verified.
+func TestVerificationSampleRate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var args roachpb.BatchRequest
+	args.Add(roachpb.NewGet(roachpb.Key("a")))
+	value := roachpb.MakeValueFromString("value")
+	value.InitChecksum(roachpb.Key("b"))
+	corrupt := &roachpb.BatchResponse{}
+	corrupt.Add(&roachpb.GetResponse{Value: &value})
+
+	const rate, n = 10, 10000
+	opts := SendOptions{VerificationMode: verifyFail, VerificationSampleRate: rate}
+	var verified int
+	for i := 0; i < n; i++ {
+		if call := makeBatchCall(opts, &batchClient{args: args}, corrupt, nil); call.err != nil {
+			verified++
+		}
+	}
+	if expected := n / rate; verified < expected*9/10 || verified > expected*11/10 {
+		t.Errorf("expected about %d of %d replies to be verified, got %d", expected, n, verified)
+	}
+}
+
+// TestVerificationSeed verifies that the same seed selects the same responses
+// for verification.
+func TestVerificationSeed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const n = 100
+	selected := func(seed int64) []int {
+		sample := verificationSampler(SendOptions{VerificationSampleRate: 10, VerificationSeed: seed})
+		var indices []int
+		for i := 0; i < n; i++ {
+			if sample() {
+				indices = append(indices, i)
+			}
+		}
+		return indices
+	}
+
+	first := selected(42)
+	if len(first) == 0 || len(first) == n {
+		t.Fatalf("expected some but not all of %d responses to be selected, got %v", n, first)
+	}
+	if second := selected(42); !reflect.DeepEqual(first, second) {
+		t.Errorf("expected the same seed to select %v, got %v", first, second)
+	}
+	if other := selected(43); reflect.DeepEqual(first, other) {
+		t.Errorf("expected a different seed to select different responses than %v", first)
+	}
+}
+
+// benchmarkVerification measures makeBatchCall verifying a reply to a batch
+// of 100 gets at the given sample rate.
+func benchmarkVerification(b *testing.B, sampleRate int) {
+	var args roachpb.BatchRequest
+	reply := &roachpb.BatchResponse{}
+	for i := 0; i < 100; i++ {
+		key := roachpb.Key(fmt.Sprintf("key%03d", i))
+		args.Add(roachpb.NewGet(key))
+		value := roachpb.MakeValueFromString("value")
+		value.InitChecksum(key)
+		reply.Add(&roachpb.GetResponse{Value: &value})
+	}
+	client := &batchClient{args: args}
+	opts := SendOptions{VerificationMode: verifyFail, VerificationSampleRate: sampleRate}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if call := makeBatchCall(opts, client, reply, nil); call.err != nil {
+			b.Fatal(call.err)
+		}
+	}
+}
+
+func BenchmarkVerification(b *testing.B) {
+	benchmarkVerification(b, 0)
+}
+
+func BenchmarkVerificationSampled(b *testing.B) {
+	benchmarkVerification(b, 10)
+}
+
+// TestSortByRTT verifies that clients are ordered by ascending round-trip
+// time, with clients of unknown round-trip time last.
+func TestSortByRTT(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addrs := []string{"unknown", "slow", "fast", "medium"}
+	rtts := []time.Duration{0, 30 * time.Millisecond, 1 * time.Millisecond, 10 * time.Millisecond}
+	healthy := []bool{true, true, true, true}
+
+	expected := []string{"fast", "medium", "slow", "unknown"}
+	for i, j := range OrderByHealthAndRTT(healthy, rtts) {
+		if addrs[j] != expected[i] {
+			t.Errorf("%d: expected %s, got %s", i, expected[i], addrs[j])
+		}
+	}
+}
+
+// TestOrderClients verifies the client sequence produced by each ordering
+// policy for healthy clients with differing round-trip times.
+func TestOrderClients(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// No connections are needed, as the probe stands in for them.
+	healthy := func(string) bool { return true }
+	makeClients := func() []batchClient {
+		var clients []batchClient
+		for i, rtt := range []time.Duration{0, 30, 10, 20} {
+			clients = append(clients, batchClient{
+				remoteAddr: fmt.Sprintf("c%d", i),
+				rtt:        rtt * time.Millisecond,
+			})
+		}
+		return clients
+	}
+	addrs := func(clients []batchClient) string {
+		var s []string
+		for _, client := range clients {
+			s = append(s, client.remoteAddr)
+		}
+		return strings.Join(s, ",")
+	}
+
+	testCases := []struct {
+		ordering orderingPolicy
+		expected string
+	}{
+		{orderStable, "c0,c1,c2,c3"},
+		// All clients are healthy, so the round-trip times alone determine
+		// the order.
+		{orderClosest, "c2,c3,c1,c0"},
+	}
+	for _, test := range testCases {
+		clients := makeClients()
+		if err := orderClients(test.ordering, clients, healthy, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		if a := addrs(clients); a != test.expected {
+			t.Errorf("ordering %d: expected %s, got %s", test.ordering, test.expected, a)
+		}
+	}
+
+	// The random ordering must not favor the closest client: every client
+	// is tried first eventually.
+	firsts := map[string]struct{}{}
+	for i := 0; i < 100 && len(firsts) < 4; i++ {
+		clients := makeClients()
+		if err := orderClients(orderRandom, clients, healthy, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		firsts[clients[0].remoteAddr] = struct{}{}
+	}
+	if len(firsts) != 4 {
+		t.Errorf("expected every client to be tried first, got only %v", firsts)
+	}
+
+	// The weighted random ordering may start anywhere, but must try the
+	// remaining clients in the order provided.
+	clients := makeClients()
+	if err := orderClients(orderWeightedRandom, clients, healthy, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	var rest []string
+	for _, client := range clients[1:] {
+		rest = append(rest, client.remoteAddr)
+	}
+	if !sort.StringsAreSorted(rest) {
+		t.Errorf("expected clients after the first in the order provided, got %s", addrs(clients))
+	}
+
+	// The random orderings are reproducible given the same source.
+	for _, ordering := range []orderingPolicy{orderRandom, orderWeightedRandom} {
+		var orders []string
+		for i := 0; i < 2; i++ {
+			clients := makeClients()
+			if err := orderClients(ordering, clients, healthy, false, rand.New(rand.NewSource(7))); err != nil {
+				t.Fatal(err)
+			}
+			orders = append(orders, addrs(clients))
+		}
+		if orders[0] != orders[1] {
+			t.Errorf("ordering %d: expected the same order from the same seed, got %s and %s",
+				ordering, orders[0], orders[1])
+		}
+	}
+}
+
+// TestOrderByHealthAndRTT verifies that healthy replicas are ordered first,
+// by ascending round-trip time with unknown ones last, followed by the
+// unhealthy replicas in the order provided.
+func TestOrderByHealthAndRTT(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ms := time.Millisecond
+	testCases := []struct {
+		healthy  []bool
+		rtts     []time.Duration
+		expected []int
+	}{
+		{nil, nil, []int{}},
+		{[]bool{true, true, true}, []time.Duration{30 * ms, 10 * ms, 20 * ms}, []int{1, 2, 0}},
+		{[]bool{true, true, true}, []time.Duration{0, 10 * ms, 0}, []int{1, 0, 2}},
+		{[]bool{false, false, true}, []time.Duration{10 * ms, 20 * ms, 30 * ms}, []int{2, 0, 1}},
+		{[]bool{false, true, false, true}, []time.Duration{1 * ms, 20 * ms, 2 * ms, 10 * ms}, []int{3, 1, 0, 2}},
+	}
+	for i, test := range testCases {
+		if order := OrderByHealthAndRTT(test.healthy, test.rtts); !reflect.DeepEqual(order, test.expected) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, order)
+		}
+	}
+}
+
+// TestSplitHealthy verifies that splitting off the healthy clients keeps the
+// relative order of both the healthy and the unhealthy ones.
+func TestSplitHealthy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var clients []batchClient
+	for _, addr := range []string{"u1", "h1", "u2", "u3", "h2"} {
+		clients = append(clients, batchClient{remoteAddr: addr})
+	}
+	probe := func(addr string) bool {
+		return strings.HasPrefix(addr, "h")
+	}
+	nHealthy, err := splitHealthy(clients, probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nHealthy != 2 {
+		t.Errorf("expected 2 healthy clients, got %d", nHealthy)
+	}
+	var addrs []string
+	for _, client := range clients {
+		addrs = append(addrs, client.remoteAddr)
+	}
+	if expected := []string{"h1", "h2", "u1", "u2", "u3"}; !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("expected %v, got %v", expected, addrs)
+	}
+
+	// Splitting is done before each failover, so it must not allocate.
+	if allocs := testing.AllocsPerRun(10, func() {
+		_, _ = splitHealthy(clients, probe)
+	}); allocs != 0 {
+		t.Errorf("expected no allocations, got %.1f", allocs)
+	}
+}
+
+// TestHealthProbe verifies that a HealthProbe, rather than the connection
+// state, determines which clients are ordered first.
+func TestHealthProbe(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var clients []batchClient
+	for i, rtt := range []time.Duration{0, 30, 10, 20} {
+		// No connections are needed, as the probe stands in for them.
+		clients = append(clients, batchClient{
+			remoteAddr: fmt.Sprintf("c%d", i),
+			rtt:        rtt * time.Millisecond,
+		})
+	}
+	probe := func(addr string) bool {
+		return addr != "c2" && addr != "c3"
+	}
+	if err := orderClients(orderClosest, clients, probe, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	for _, client := range clients {
+		addrs = append(addrs, client.remoteAddr)
+	}
+	// The healthy clients come first, ordered by RTT with the unknown one
+	// last, followed by the unhealthy ones.
+	if expected := []string{"c1", "c0", "c2", "c3"}; !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("expected %v, got %v", expected, addrs)
+	}
+}
+
+// TestRandomizeTies verifies that randomizing ties spreads the first attempt
+// across the healthy clients with equal RTTs, while the unhealthy client
+// stays last and the order is stable by default.
+func TestRandomizeTies(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	makeClients := func() []batchClient {
+		var clients []batchClient
+		for i, rtt := range []time.Duration{10, 0, 10, 10, 5} {
+			clients = append(clients, batchClient{
+				remoteAddr: fmt.Sprintf("c%d", i),
+				rtt:        rtt * time.Millisecond,
+			})
+		}
+		return clients
+	}
+	probe := func(addr string) bool {
+		return addr != "c4"
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	counts := map[string]int{}
+	for i := 0; i < 300; i++ {
+		clients := makeClients()
+		if err := orderClients(orderClosest, clients, probe, true, rng); err != nil {
+			t.Fatal(err)
+		}
+		counts[clients[0].remoteAddr]++
+		if a := clients[3].remoteAddr; a != "c1" {
+			t.Fatalf("expected the client with unknown RTT after the tied ones, got %s", a)
+		}
+		if a := clients[4].remoteAddr; a != "c4" {
+			t.Fatalf("expected the unhealthy client last, got %s", a)
+		}
+	}
+	for _, addr := range []string{"c0", "c2", "c3"} {
+		// Each of the three tied clients is expected first 100 times.
+		if counts[addr] < 50 {
+			t.Errorf("expected %s to be tried first often, got %v", addr, counts)
+		}
+	}
+
+	clients := makeClients()
+	if err := orderClients(orderClosest, clients, probe, false, rng); err != nil {
+		t.Fatal(err)
+	}
+	if a := clients[0].remoteAddr; a != "c0" {
+		t.Errorf("expected ties in the order provided by default, got %s first", a)
+	}
+}
+
+// fakeLatencySource is a LatencySource backed by a map.
+type fakeLatencySource map[string]time.Duration
+
+func (f fakeLatencySource) Latency(addr string) (time.Duration, bool) {
+	rtt, ok := f[addr]
+	return rtt, ok
+}
+
+// TestLatencySource verifies that send orders replicas by the round-trip
+// times of the provided LatencySource.
+func TestLatencySource(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	var addrs []net.Addr
+	for i := 0; i < 3; i++ {
+		_, addr := newReadyConn(t, nodeContext)
+		addrs = append(addrs, util.NewUnresolvedAddr("tcp", addr))
+	}
+	latencies := fakeLatencySource{
+		addrs[0].String(): 30 * time.Millisecond,
+		addrs[1].String(): 10 * time.Millisecond,
+		addrs[2].String(): 20 * time.Millisecond,
+	}
+
+	var sentTo []string
+	sendOneFn = recordingSendOne(&sentTo, errors.New("failure"))
+	defer func() { sendOneFn = sendOne }()
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := testSendOptions(orderClosest, sp)
+	opts.LatencySource = latencies
+	if _, err := sendBatch(opts, addrs, nodeContext); err == nil {
+		t.Fatal("expected all replicas to fail")
+	}
+	expected := []string{addrs[1].String(), addrs[2].String(), addrs[0].String()}
+	if !reflect.DeepEqual(sentTo, expected) {
+		t.Errorf("expected to send to %v, got %v", expected, sentTo)
+	}
+}
+
+// TestPickByInverseRTT verifies that the first client is chosen with a
+// probability inversely proportional to its round-trip time.
+func TestPickByInverseRTT(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng := rand.New(rand.NewSource(1))
+	const iterations = 7000
+	counts := map[string]int{}
+	for i := 0; i < iterations; i++ {
+		clients := []batchClient{
+			{remoteAddr: "fast", rtt: 1 * time.Millisecond},
+			{remoteAddr: "medium", rtt: 2 * time.Millisecond},
+			{remoteAddr: "slow", rtt: 4 * time.Millisecond},
+		}
+		pickByInverseRTT(clients, rng.Float64)
+		counts[clients[0].remoteAddr]++
+	}
+
+	// The weights are 1, 1/2 and 1/4, i.e. 4/7, 2/7 and 1/7 of the picks.
+	expected := map[string]int{"fast": 4000, "medium": 2000, "slow": 1000}
+	for addr, exp := range expected {
+		if c := counts[addr]; c < exp*9/10 || c > exp*11/10 {
+			t.Errorf("%s: expected about %d picks, got %d", addr, exp, c)
+		}
+	}
+}
+
+// TestBatchCallCode verifies that the gRPC status code of an error is
+// recorded on the batchCall.
+func TestBatchCallCode(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testCases := []struct {
+		err     error
+		expCode codes.Code
+	}{
+		{nil, codes.OK},
+		{errors.New("not a grpc error"), codes.Unknown},
+		{newRPCError(errors.New("not sent")), codes.Unavailable},
+		{grpc.Errorf(codes.Unavailable, "unavailable"), codes.Unavailable},
+		{grpc.Errorf(codes.ResourceExhausted, "exhausted"), codes.ResourceExhausted},
+		{grpc.Errorf(codes.DeadlineExceeded, "deadline"), codes.DeadlineExceeded},
+	}
+	for i, test := range testCases {
+		call := makeBatchCall(SendOptions{}, &batchClient{}, nil, test.err)
+		if call.code != test.expCode {
+			t.Errorf("%d: expected code %s, got %s", i, test.expCode, call.code)
+		}
+		if call.err != test.err {
+			t.Errorf("%d: expected error %v to be preserved, got %v", i, test.err, call.err)
+		}
+	}
+}
+
+// TestBatchCallRetryable verifies that read-only batches are retryable on any
+// error, while writes are retryable only if the error shows they were never
+// delivered.
+func TestBatchCallRetryable(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var read, write roachpb.BatchRequest
+	read.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("a")}})
+	write.Add(&roachpb.PutRequest{Span: roachpb.Span{Key: roachpb.Key("a")}})
+
+	timeout := grpc.Errorf(codes.DeadlineExceeded, "deadline")
+	refused := grpc.Errorf(codes.Unavailable, "connection refused")
+	testCases := []struct {
+		args         roachpb.BatchRequest
+		err          error
+		expRetryable bool
+	}{
+		{read, nil, false},
+		{read, timeout, true},
+		{read, refused, true},
+		{write, nil, false},
+		{write, timeout, false},
+		// Unavailable may also mean that the transport closed after the
+		// write was sent.
+		{write, refused, false},
+		{write, newRPCError(errors.New("not sent")), true},
+	}
+	for i, test := range testCases {
+		call := makeBatchCall(SendOptions{}, &batchClient{args: test.args}, nil, test.err)
+		if call.retryable != test.expRetryable {
+			t.Errorf("%d: expected retryable=%t, got %t", i, test.expRetryable, call.retryable)
+		}
+	}
+}
+
+// TestSendErrorRetryable verifies that whether send's error is retryable is
+// decided by the errors themselves, not by the batch being read-only.
+func TestSendErrorRetryable(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	_, ln := newTestServer(t, nodeContext)
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+
+	opts := SendOptions{
+		Ordering:        orderStable,
+		SendNextTimeout: 1 * time.Second,
+		Timeout:         10 * time.Second,
+		Trace:           sp,
+	}
+
+	var read, write roachpb.BatchRequest
+	read.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("a")}})
+	write.Add(&roachpb.PutRequest{Span: roachpb.Span{Key: roachpb.Key("a")}})
+	testCases := []struct {
+		args         roachpb.BatchRequest
+		err          error
+		expRetryable bool
+	}{
+		// A permanent error fails a read for good.
+		{read, errors.New("user root is not allowed"), false},
+		{read, io.ErrUnexpectedEOF, true},
+		{write, newRPCError(errors.New("not sent")), true},
+		{write, errors.New("user root is not allowed"), false},
+	}
+	defer func() { sendOneFn = sendOne }()
+	for i, test := range testCases {
+		callErr := test.err
+		sendOneFn = func(opts SendOptions, _ *rpc.Context, client batchClient, done chan batchCall) {
+			done <- makeBatchCall(opts, &client, nil, callErr)
+		}
+		_, err := send(opts, makeReplicas(ln.Addr()), test.args, nodeContext)
+		retryErr, ok := err.(retry.Retryable)
+		if !ok {
+			t.Fatalf("%d: unexpected error type: %v", i, err)
+		}
+		if retryErr.CanRetry() != test.expRetryable {
+			t.Errorf("%d: expected retryable=%t, got %v", i, test.expRetryable, retryErr)
+		}
+	}
+}
+
+// TestSendOneCancelMidFlight verifies that cancelling opts.Context cancels the
+// context of an RPC already in flight.
+func TestSendOneCancelMidFlight(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	conn, addr := newReadyConn(t, nodeContext)
+
+	started := make(chan struct{})
+	client := fakeInternalClient(func(ctx context.Context, _ *roachpb.BatchRequest,
+		_ ...grpc.CallOption) (*roachpb.BatchResponse, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{Trace: sp, Context: ctx}
+	done := make(chan batchCall, 1)
+	sendOne(opts, nodeContext, batchClient{remoteAddr: addr, conn: conn, client: client}, done)
+
+	<-started
+	cancel()
+	if call := <-done; call.err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, call.err)
+	}
+}
+
+// TestSemaphore verifies that RPCs sharing a semaphore wait for a free slot,
+// and stop waiting when their context is done.
+func TestSemaphore(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	conn, addr := newReadyConn(t, nodeContext)
+
+	started := make(chan int, 2)
+	release := make(chan struct{})
+	makeClient := func(id int) batchClient {
+		return batchClient{
+			remoteAddr: addr,
+			conn:       conn,
+			client: fakeInternalClient(func(context.Context, *roachpb.BatchRequest,
+				...grpc.CallOption) (*roachpb.BatchResponse, error) {
+				started <- id
+				<-release
+				return &roachpb.BatchResponse{}, nil
+			}),
+		}
+	}
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{Trace: sp, Semaphore: make(chan struct{}, 1)}
+	done := make(chan batchCall, 3)
+	sendOne(opts, nodeContext, makeClient(1), done)
+	if id := <-started; id != 1 {
+		t.Fatalf("expected RPC 1 to start, got %d", id)
+	}
+	sendOne(opts, nodeContext, makeClient(2), done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelledOpts := opts
+	cancelledOpts.Context = ctx
+	sendOne(cancelledOpts, nodeContext, makeClient(3), done)
+	cancel()
+	if call := <-done; call.err != context.Canceled {
+		t.Errorf("expected the waiting RPC to be cancelled, got %v", call.err)
+	}
+
+	select {
+	case id := <-started:
+		t.Fatalf("RPC %d started while the semaphore was held", id)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	if id := <-started; id != 2 {
+		t.Errorf("expected RPC 2 to start, got %d", id)
+	}
+	for i := 0; i < 2; i++ {
+		if call := <-done; call.err != nil {
+			t.Error(call.err)
+		}
+	}
+}
+
+// TestReadRetries verifies that a read-only batch is retried against the same
+// replica on a transient error, while a write is not.
+func TestReadRetries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	conn, addr := newReadyConn(t, nodeContext)
+
+	var read, write roachpb.BatchRequest
+	read.Add(roachpb.NewGet(roachpb.Key("a")))
+	write.Add(roachpb.NewPut(roachpb.Key("a"), roachpb.MakeValueFromString("value")))
+
+	testCases := []struct {
+		args     roachpb.BatchRequest
+		expCalls int
+		expErr   bool
+	}{
+		{read, 2, false},
+		{write, 1, true},
+	}
+	for i, test := range testCases {
+		var calls int
+		client := fakeInternalClient(func(context.Context, *roachpb.BatchRequest,
+			...grpc.CallOption) (*roachpb.BatchResponse, error) {
+			calls++
+			if calls == 1 {
+				return nil, grpc.Errorf(codes.Unavailable, "unavailable")
+			}
+			return &roachpb.BatchResponse{}, nil
+		})
+
+		sp := tracing.NewTracer().StartSpan("node test")
+		opts := SendOptions{Trace: sp, ReadRetries: 1}
+		done := make(chan batchCall, 1)
+		sendOne(opts, nodeContext, batchClient{remoteAddr: addr, conn: conn, client: client, args: test.args}, done)
+		call := <-done
+		sp.Finish()
+
+		if (call.err != nil) != test.expErr {
+			t.Errorf("%d: expected error %t, got %v", i, test.expErr, call.err)
+		}
+		if calls != test.expCalls {
+			t.Errorf("%d: expected %d calls, got %d", i, test.expCalls, calls)
+		}
+		if call.retries != test.expCalls-1 {
+			t.Errorf("%d: expected %d retries, got %d", i, test.expCalls-1, call.retries)
+		}
+	}
+}
+
+// TestReadRetriesSemaphore verifies that a read backing off before a retry
+// does not hold a slot of the semaphore.
+func TestReadRetriesSemaphore(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	defer func(prev retry.Options) { readRetryOptions = prev }(readRetryOptions)
+	readRetryOptions = retry.Options{
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	conn, addr := newReadyConn(t, nodeContext)
+
+	failed := make(chan struct{})
+	var calls int
+	client := fakeInternalClient(func(context.Context, *roachpb.BatchRequest,
+		...grpc.CallOption) (*roachpb.BatchResponse, error) {
+		calls++
+		if calls == 1 {
+			close(failed)
+			return nil, grpc.Errorf(codes.Unavailable, "unavailable")
+		}
+		return &roachpb.BatchResponse{}, nil
+	})
+
+	var args roachpb.BatchRequest
+	args.Add(roachpb.NewGet(roachpb.Key("a")))
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	sem := make(chan struct{}, 1)
+	opts := SendOptions{Trace: sp, ReadRetries: 1, Semaphore: sem}
+	done := make(chan batchCall, 1)
+	sendOne(opts, nodeContext, batchClient{remoteAddr: addr, conn: conn, client: client, args: args}, done)
+
+	<-failed
+	select {
+	case sem <- struct{}{}:
+		<-sem
+	case <-time.After(500 * time.Millisecond):
+		t.Errorf("semaphore held while backing off")
+	}
+	if call := <-done; call.err != nil {
+		t.Fatal(call.err)
+	}
+}
+
+// TestReadRetriesConnDropped verifies that a read is not retried on a
+// connection which dropped along with the RPC until it is ready again.
+func TestReadRetriesConnDropped(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	clientStopper := stop.NewStopper()
+	defer clientStopper.Stop()
+	clientContext := newNodeTestContext(nil, clientStopper)
+
+	serverStopper := stop.NewStopper()
+	serverContext := newNodeTestContext(nil, serverStopper)
+	s, ln := newTestServer(t, serverContext)
+	roachpb.RegisterInternalServer(s, Node(0))
+
+	conn, err := clientContext.GRPCDial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForConnState(t, conn, grpc.Ready)
+
+	var calls int
+	client := fakeInternalClient(func(ctx context.Context, _ *roachpb.BatchRequest,
+		_ ...grpc.CallOption) (*roachpb.BatchResponse, error) {
+		calls++
+		if calls == 1 {
+			// Drop the connection, and wait for the client to notice.
+			serverStopper.Stop()
+			if _, err := conn.WaitForStateChange(ctx, grpc.Ready); err != nil {
+				return nil, err
+			}
+			return nil, grpc.Errorf(codes.Unavailable, "unavailable")
+		}
+		return &roachpb.BatchResponse{}, nil
+	})
+
+	var args roachpb.BatchRequest
+	args.Add(roachpb.NewGet(roachpb.Key("a")))
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{Trace: sp, ReadRetries: 1, Timeout: 100 * time.Millisecond}
+	done := make(chan batchCall, 1)
+	sendOne(opts, clientContext, batchClient{remoteAddr: ln.Addr().String(), conn: conn, client: client, args: args}, done)
+
+	call := <-done
+	if call.err == nil {
+		t.Errorf("expected an error as the connection never became ready again")
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 call, got %d", calls)
+	}
+}
+
+// TestClientTimeout verifies that an RPC failing because its timeout expired
+// on the client is told apart from one the server gave up on.
+func TestClientTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	conn, addr := newReadyConn(t, nodeContext)
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{Trace: sp, Timeout: 10 * time.Millisecond}
+
+	for _, serverSide := range []bool{false, true} {
+		client := fakeInternalClient(func(ctx context.Context, _ *roachpb.BatchRequest,
+			_ ...grpc.CallOption) (*roachpb.BatchResponse, error) {
+			if !serverSide {
+				<-ctx.Done()
+			}
+			return nil, grpc.Errorf(codes.DeadlineExceeded, "deadline exceeded")
+		})
+		done := make(chan batchCall, 1)
+		sendOne(opts, nodeContext, batchClient{remoteAddr: addr, conn: conn, client: client}, done)
+		call := <-done
+
+		if _, ok := call.err.(clientTimeoutError); ok == serverSide {
+			t.Errorf("server side %t: unexpected error %v", serverSide, call.err)
+		}
+		if call.code != codes.DeadlineExceeded {
+			t.Errorf("server side %t: expected code %s, got %s", serverSide, codes.DeadlineExceeded, call.code)
+		}
+	}
+}
+
+// TestSendOneCancelledContext verifies that sendOne does not dispatch an RPC
+// when its context is already cancelled.
+func TestSendOneCancelledContext(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts := SendOptions{
+		Trace:   sp,
+		Context: ctx,
+	}
+
+	var sent bool
+	client := batchClient{
+		remoteAddr: "fake",
+		client: fakeInternalClient(func(context.Context, *roachpb.BatchRequest,
+			...grpc.CallOption) (*roachpb.BatchResponse, error) {
+			sent = true
+			return &roachpb.BatchResponse{}, nil
+		}),
+	}
+	done := make(chan batchCall, 1)
+	// The rpc.Context is not needed as no dispatch may happen.
+	sendOne(opts, nil, client, done)
+
+	call := <-done
+	if call.err != context.Canceled {
+		t.Errorf("expected %s, got %v", context.Canceled, call.err)
+	}
+	if sent {
+		t.Errorf("unexpected RPC to %s", client.remoteAddr)
+	}
+}
+
+// TestSendOneConnClosed verifies that a batch which is not sent because its
+// connection has shut down is reported with codes.Unavailable.
+func TestSendOneConnClosed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	conn, addr := newReadyConn(t, nodeContext)
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+
+	client := batchClient{
+		remoteAddr: addr,
+		conn:       conn,
+		client:     roachpb.NewInternalClient(conn),
+	}
+	client.args.Add(&roachpb.PutRequest{Span: roachpb.Span{Key: roachpb.Key("a")}})
+	done := make(chan batchCall, 1)
+	sendOne(SendOptions{Trace: sp}, nodeContext, client, done)
+
+	call := <-done
+	if !testutils.IsError(call.err, "failed as client connection was closed") {
+		t.Fatalf("unexpected error: %v", call.err)
+	}
+	if call.code != codes.Unavailable {
+		t.Errorf("expected code %s, got %s", codes.Unavailable, call.code)
+	}
+	if call.remoteAddr != addr {
+		t.Errorf("expected reply from %s, got %s", addr, call.remoteAddr)
+	}
+}
+
+// TestSendOneReleasesContext verifies that the context of an RPC bound by a
+// deadline and a timeout is cancelled once the RPC has finished, rather than
+// lingering until they expire.
+func TestSendOneReleasesContext(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	conn, addr := newReadyConn(t, nodeContext)
+
+	ctxs := make(chan context.Context, 1)
+	client := batchClient{
+		remoteAddr: addr,
+		conn:       conn,
+		client: fakeInternalClient(func(ctx context.Context, _ *roachpb.BatchRequest,
+			_ ...grpc.CallOption) (*roachpb.BatchResponse, error) {
+			ctxs <- ctx
+			return &roachpb.BatchResponse{}, nil
+		}),
+	}
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{
+		Trace:           sp,
+		Timeout:         time.Hour,
+		OverallDeadline: time.Now().Add(time.Hour),
+	}
+	done := make(chan batchCall, 1)
+	sendOne(opts, nodeContext, client, done)
+	if call := <-done; call.err != nil {
+		t.Fatal(call.err)
+	}
+	select {
+	case <-(<-ctxs).Done():
+	case <-time.After(time.Second):
+		t.Errorf("context of the RPC not cancelled after it finished")
+	}
+}
+
+// TestSendCancelledContext verifies that send returns the error of an already
+// cancelled context without trying any replica.
+func TestSendCancelledContext(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	var addrs []net.Addr
+	for i := 0; i < 3; i++ {
+		_, ln := newTestServer(t, nodeContext)
+		addrs = append(addrs, ln.Addr())
+	}
+
+	var calls int
+	sendOneFn = func(_ SendOptions, _ *rpc.Context, client batchClient, done chan batchCall) {
+		calls++
+		done <- batchCall{remoteAddr: client.remoteAddr, err: context.Canceled}
+	}
+	defer func() { sendOneFn = sendOne }()
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts := SendOptions{
+		Ordering:        orderStable,
+		SendNextTimeout: 1 * time.Second,
+		Timeout:         10 * time.Second,
+		Trace:           sp,
+		Context:         ctx,
+	}
+	if _, err := sendBatch(opts, addrs, nodeContext); err != context.Canceled {
+		t.Errorf("expected %s, got %v", context.Canceled, err)
+	}
+	if calls != 0 {
+		t.Errorf("expected no replica to be tried, got %d", calls)
+	}
+}
+
+// TestPutBatchClientsClears verifies that slices returned to the pool don't
+// retain the clients they held.
+func TestPutBatchClientsClears(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	p := batchClientsPool.Get().(*[]batchClient)
+	clients := append((*p)[:0],
+		batchClient{remoteAddr: "a", conn: &grpc.ClientConn{}},
+		batchClient{remoteAddr: "b", conn: &grpc.ClientConn{}},
+	)
+	putBatchClients(p, clients)
+
+	if l := len(*p); l != 0 {
+		t.Fatalf("expected empty slice, got length %d", l)
+	}
+	for i, client := range (*p)[:cap(*p)] {
+		if client.remoteAddr != "" || client.conn != nil {
+			t.Errorf("%d: pooled slice retains client %+v", i, client)
+		}
+	}
+}
+
+// BenchmarkSend measures the overhead of send, with RPCs mocked out, across
+// three replicas.
+func BenchmarkSend(b *testing.B) {
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	var addrs []net.Addr
+	for i := 0; i < 3; i++ {
+		s := rpc.NewServer(nodeContext)
+		ln, err := util.ListenAndServeGRPC(stopper, s, util.TestAddr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		addrs = append(addrs, ln.Addr())
+	}
+	replicas := makeReplicas(addrs...)
+
+	sendOneFn = func(_ SendOptions, _ *rpc.Context, client batchClient, done chan batchCall) {
+		done <- batchCall{remoteAddr: client.remoteAddr, reply: &roachpb.BatchResponse{}}
+	}
+	defer func() { sendOneFn = sendOne }()
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{
+		Ordering:        orderRandom,
+		SendNextTimeout: 1 * time.Second,
+		Timeout:         10 * time.Second,
+		Trace:           sp,
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := send(opts, replicas, roachpb.BatchRequest{}, nodeContext); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestPriorityMetadata verifies that the user priority of a batch is sent as
+// gRPC metadata, and that no metadata is sent without a priority.
+func TestPriorityMetadata(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	conn, addr := newReadyConn(t, nodeContext)
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{Trace: sp}
+
+	for _, priority := range []roachpb.UserPriority{0, 2.5} {
+		mds := make(chan metadata.MD, 1)
+		client := batchClient{
+			remoteAddr: addr,
+			conn:       conn,
+			client: fakeInternalClient(func(ctx context.Context, _ *roachpb.BatchRequest,
+				_ ...grpc.CallOption) (*roachpb.BatchResponse, error) {
+				md, _ := metadata.FromContext(ctx)
+				mds <- md
+				return &roachpb.BatchResponse{}, nil
+			}),
+		}
+		client.args.UserPriority = priority
+
+		done := make(chan batchCall, 1)
+		sendOne(opts, nodeContext, client, done)
+		if call := <-done; call.err != nil {
+			t.Fatal(call.err)
+		}
+
+		values, ok := (<-mds)[priorityMetadataKey]
+		if priority == 0 {
+			if ok {
+				t.Errorf("unexpected priority metadata %v", values)
+			}
+		} else if len(values) != 1 || values[0] != "2.5" {
+			t.Errorf("expected priority metadata [2.5], got %v", values)
+		}
+	}
+}
+
+// TestRequestMetadataMerged verifies that the metadata sent along with a batch
+// is added to, rather than replaces, the metadata of the caller's context.
+func TestRequestMetadataMerged(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	conn, addr := newReadyConn(t, nodeContext)
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{
+		Trace:   sp,
+		Context: metadata.NewContext(context.Background(), metadata.MD{"caller": []string{"value"}}),
+	}
+
+	mds := make(chan metadata.MD, 1)
+	client := batchClient{
+		remoteAddr: addr,
+		conn:       conn,
+		client: fakeInternalClient(func(ctx context.Context, _ *roachpb.BatchRequest,
+			_ ...grpc.CallOption) (*roachpb.BatchResponse, error) {
+			md, _ := metadata.FromContext(ctx)
+			mds <- md
+			return &roachpb.BatchResponse{}, nil
+		}),
+	}
+	client.args.UserPriority = 2.5
+
+	done := make(chan batchCall, 1)
+	sendOne(opts, nodeContext, client, done)
+	if call := <-done; call.err != nil {
+		t.Fatal(call.err)
+	}
+
+	md := <-mds
+	if values := md["caller"]; len(values) != 1 || values[0] != "value" {
+		t.Errorf("expected caller metadata [value], got %v", values)
+	}
+	if values := md[priorityMetadataKey]; len(values) != 1 || values[0] != "2.5" {
+		t.Errorf("expected priority metadata [2.5], got %v", values)
+	}
+}
+
+// TestBudgetMetadata verifies that the time left until the deadline of an RPC
+// is sent as gRPC metadata, and that no metadata is sent without a deadline.
+func TestBudgetMetadata(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	conn, addr := newReadyConn(t, nodeContext)
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+
+	for _, timeout := range []time.Duration{0, 10 * time.Second} {
+		mds := make(chan metadata.MD, 1)
+		client := batchClient{
+			remoteAddr: addr,
+			conn:       conn,
+			client: fakeInternalClient(func(ctx context.Context, _ *roachpb.BatchRequest,
+				_ ...grpc.CallOption) (*roachpb.BatchResponse, error) {
+				md, _ := metadata.FromContext(ctx)
+				mds <- md
+				return &roachpb.BatchResponse{}, nil
+			}),
+		}
+
+		done := make(chan batchCall, 1)
+		sendOne(SendOptions{Trace: sp, Timeout: timeout}, nodeContext, client, done)
+		if call := <-done; call.err != nil {
+			t.Fatal(call.err)
+		}
+
+		values, ok := (<-mds)[budgetMetadataKey]
+		if timeout == 0 {
+			if ok {
+				t.Errorf("unexpected budget metadata %v", values)
+			}
+			continue
+		}
+		if len(values) != 1 {
+			t.Fatalf("expected one budget value, got %v", values)
+		}
+		budget, err := strconv.ParseInt(values[0], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		min, max := int64((timeout-time.Second)/time.Millisecond), int64(timeout/time.Millisecond)
+		if budget < min || budget > max {
+			t.Errorf("expected a budget between %dms and %dms, got %dms", min, max, budget)
+		}
+	}
+}
+
+// TestBudgetMetadataAfterWait verifies that the budget sent along with a batch
+// accounts for the time spent waiting to send it.
+func TestBudgetMetadataAfterWait(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	conn, addr := newReadyConn(t, nodeContext)
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+
+	// Hold the only slot of the semaphore for a while.
+	const timeout, wait = 2 * time.Second, 500 * time.Millisecond
+	sem := make(chan struct{}, 1)
+	sem <- struct{}{}
+	time.AfterFunc(wait, func() { <-sem })
+
+	mds := make(chan metadata.MD, 1)
+	client := batchClient{
+		remoteAddr: addr,
+		conn:       conn,
+		client: fakeInternalClient(func(ctx context.Context, _ *roachpb.BatchRequest,
+			_ ...grpc.CallOption) (*roachpb.BatchResponse, error) {
+			md, _ := metadata.FromContext(ctx)
+			mds <- md
+			return &roachpb.BatchResponse{}, nil
+		}),
+	}
+
+	done := make(chan batchCall, 1)
+	sendOne(SendOptions{Trace: sp, Timeout: timeout, Semaphore: sem}, nodeContext, client, done)
+	if call := <-done; call.err != nil {
+		t.Fatal(call.err)
+	}
+
+	values := (<-mds)[budgetMetadataKey]
+	if len(values) != 1 {
+		t.Fatalf("expected one budget value, got %v", values)
+	}
+	budget, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if max := int64((timeout - wait) / time.Millisecond); budget > max {
+		t.Errorf("expected a budget of at most %dms, got %dms", max, budget)
+	}
+}
+
+// TestProbeReplica verifies that probing a replica reports its latency if its
+// server answers, and the error if it doesn't.
+func TestProbeReplica(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	const delay = 10 * time.Millisecond
+	healthy, healthyLn := newTestServer(t, nodeContext)
+	roachpb.RegisterInternalServer(healthy, Node(delay))
+	unhealthy, unhealthyLn := newTestServer(t, nodeContext)
+	roachpb.RegisterInternalServer(unhealthy, replyErrNode{errors.New("store unavailable")})
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{
+		Ordering:        orderStable,
+		SendNextTimeout: 1 * time.Second,
+		Timeout:         10 * time.Second,
+		Trace:           sp,
+	}
+
+	latency, err := ProbeReplica(opts, 1, makeReplicas(healthyLn.Addr())[0], nodeContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency < delay {
+		t.Errorf("expected a latency of at least %s, got %s", delay, latency)
+	}
+	if _, err := ProbeReplica(opts, 1, makeReplicas(unhealthyLn.Addr())[0], nodeContext); !testutils.IsError(err, "store unavailable") {
+		t.Errorf("expected the server's error, got %v", err)
+	}
+}
+
+// TestFailoverEvent verifies that failing over from one replica to the next
+// records an event naming both replicas, the error and the attempt.
+func TestFailoverEvent(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	_, ln1 := newTestServer(t, nodeContext)
+	_, ln2 := newTestServer(t, nodeContext)
+	first, second := ln1.Addr().String(), ln2.Addr().String()
+
+	var events []string
+	sp, err := tracing.JoinOrNewSnowball("node test", nil, func(rs basictracer.RawSpan) {
+		for _, l := range rs.Logs {
+			events = append(events, l.Event)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("replica failure")
+	sendOneFn = func(_ SendOptions, _ *rpc.Context, client batchClient, done chan batchCall) {
+		call := batchCall{remoteAddr: client.remoteAddr, reply: &roachpb.BatchResponse{}}
+		if client.remoteAddr == first {
+			call.reply, call.err = nil, failure
+		}
+		done <- call
+	}
+	defer func() { sendOneFn = sendOne }()
+
+	opts := SendOptions{
+		Ordering:        orderStable,
+		SendNextTimeout: 1 * time.Second,
+		Timeout:         10 * time.Second,
+		Trace:           sp,
+	}
+	if _, err := sendBatch(opts, []net.Addr{ln1.Addr(), ln2.Addr()}, nodeContext); err != nil {
+		t.Fatal(err)
+	}
+	sp.Finish()
+
+	expected := failoverEvent(first, second, failure, 2)
+	for _, event := range events {
+		if event == expected {
+			return
+		}
+	}
+	t.Errorf("expected event %q, got %q", expected, events)
+}
+
+// TestSoftTimeout verifies that an RPC, local or remote, which outlives the
+// soft timeout is reported as slow but still replies, and that send notes it
+// in the trace.
+func TestSoftTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	defer func(prev bool) { enableLocalCalls = prev }(enableLocalCalls)
+	enableLocalCalls = true
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	conn, addr := newReadyConn(t, nodeContext)
+
+	const softTimeout = 5 * time.Millisecond
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{
+		Timeout:     10 * time.Second,
+		SoftTimeout: softTimeout,
+		Trace:       sp,
+	}
+
+	for _, delay := range []time.Duration{0, 10 * softTimeout} {
+		client := fakeInternalClient(func(context.Context, *roachpb.BatchRequest,
+			...grpc.CallOption) (*roachpb.BatchResponse, error) {
+			time.Sleep(delay)
+			return &roachpb.BatchResponse{}, nil
+		})
+		done := make(chan batchCall, 1)
+		sendOne(opts, nodeContext, batchClient{remoteAddr: addr, conn: conn, client: client}, done)
+		call := <-done
+		if call.err != nil {
+			t.Fatal(call.err)
+		}
+		if expSlow := delay > 0; call.slow != expSlow {
+			t.Errorf("delay %s: expected slow=%t, got %t", delay, expSlow, call.slow)
+		}
+	}
+
+	// A slow local call is reported as well.
+	localContext := newNodeTestContext(nil, stopper)
+	localContext.SetLocalInternalServer(Node(10*softTimeout), addr)
+	done := make(chan batchCall, 1)
+	sendOne(opts, localContext, batchClient{remoteAddr: addr}, done)
+	if call := <-done; call.err != nil || !call.local || !call.slow {
+		t.Errorf("expected a slow local call, got %+v", call)
+	}
+
+	// send notes the slow reply in its trace.
+	var events []string
+	snowball, err := tracing.JoinOrNewSnowball("node test", nil, func(rs basictracer.RawSpan) {
+		for _, l := range rs.Logs {
+			events = append(events, l.Event)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ln := newTestServer(t, nodeContext)
+	roachpb.RegisterInternalServer(s, Node(10*softTimeout))
+	opts.Trace = snowball
+	opts.SendNextTimeout = 10 * time.Second
+	if _, err := sendBatch(opts, []net.Addr{ln.Addr()}, nodeContext); err != nil {
+		t.Fatal(err)
+	}
+	snowball.Finish()
+
+	expected := slowRPCEvent(ln.Addr().String(), softTimeout)
+	for _, event := range events {
+		if event == expected {
+			return
+		}
+	}
+	t.Errorf("expected event %q, got %q", expected, events)
+}
+
+// TestOverallDeadline verifies that no further replicas are tried once the
+// overall deadline has passed.
+func TestOverallDeadline(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	var addrs []net.Addr
+	for i := 0; i < 3; i++ {
+		_, ln := newTestServer(t, nodeContext)
+		addrs = append(addrs, ln.Addr())
+	}
+
+	const deadline = 50 * time.Millisecond
+	var attempts int
+	sendOneFn = func(_ SendOptions, _ *rpc.Context, client batchClient, done chan batchCall) {
+		attempts++
+		call := batchCall{remoteAddr: client.remoteAddr, err: errors.New("failure")}
+		if attempts == 1 {
+			done <- call
+			return
+		}
+		// The second attempt fails only after the deadline has passed.
+		go func() {
+			time.Sleep(2 * deadline)
+			done <- call
+		}()
+	}
+	defer func() { sendOneFn = sendOne }()
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{
+		Ordering:        orderStable,
+		SendNextTimeout: 1 * time.Second,
+		Timeout:         10 * time.Second,
+		OverallDeadline: time.Now().Add(deadline),
+		Trace:           sp,
+	}
+	_, err := sendBatch(opts, addrs, nodeContext)
+	if !testutils.IsError(err, "overall deadline exceeded") {
+		t.Fatalf("expected overall deadline error, got %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+}
+
+// TestDuplicateAddresses verifies that replicas sharing an address are only
+// tried once.
+func TestDuplicateAddresses(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	_, ln1 := newTestServer(t, nodeContext)
+	_, ln2 := newTestServer(t, nodeContext)
+
+	var sentTo []string
+	sendOneFn = recordingSendOne(&sentTo, errors.New("failure"))
+	defer func() { sendOneFn = sendOne }()
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := testSendOptions(orderStable, sp)
+	_, err := sendBatch(opts, []net.Addr{ln1.Addr(), ln2.Addr(), ln1.Addr()}, nodeContext)
+	if !testutils.IsError(err, "too many errors encountered \\(2 of 2 total\\)") {
+		t.Errorf("expected both distinct replicas to fail, got %v", err)
+	}
+	expected := []string{ln1.Addr().String(), ln2.Addr().String()}
+	if !reflect.DeepEqual(sentTo, expected) {
+		t.Errorf("expected to send to %v, got %v", expected, sentTo)
+	}
+}
+
+// TestExcludedNodes verifies that replicas on excluded nodes are skipped when
+// other replicas exist, and tried as a last resort otherwise.
+func TestExcludedNodes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	_, ln1 := newTestServer(t, nodeContext)
+	_, ln2 := newTestServer(t, nodeContext)
+
+	var sentTo []string
+	sendOneFn = recordingSendOne(&sentTo, errors.New("failure"))
+	defer func() { sendOneFn = sendOne }()
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := testSendOptions(orderStable, sp)
+	opts.ExcludedNodes = map[roachpb.NodeID]struct{}{1: {}}
+
+	testCases := []struct {
+		addrs    []net.Addr
+		expected []string
+	}{
+		{[]net.Addr{ln1.Addr(), ln2.Addr()}, []string{ln2.Addr().String()}},
+		{[]net.Addr{ln1.Addr()}, []string{ln1.Addr().String()}},
+	}
+	for i, test := range testCases {
+		sentTo = nil
+		replicas := makeReplicas(test.addrs...)
+		for j := range replicas {
+			replicas[j].NodeDesc.NodeID = roachpb.NodeID(j + 1)
+		}
+		if _, err := send(opts, replicas, roachpb.BatchRequest{}, nodeContext); err == nil {
+			t.Errorf("%d: expected an error", i)
+		}
+		if !reflect.DeepEqual(sentTo, test.expected) {
+			t.Errorf("%d: expected to send to %v, got %v", i, test.expected, sentTo)
+		}
+	}
+}
+
+// TestMinHealthyReplicas verifies that send fails without sending anything
+// when fewer replicas are healthy than required.
+func TestMinHealthyReplicas(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	var addrs []net.Addr
+	for i := 0; i < 3; i++ {
+		_, ln := newTestServer(t, nodeContext)
+		addrs = append(addrs, ln.Addr())
+	}
+	healthy := addrs[2].String()
+
+	var sentTo []string
+	sendOneFn = recordingSendOne(&sentTo, nil)
+	defer func() { sendOneFn = sendOne }()
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := testSendOptions(orderStable, sp)
+	opts.HealthProbe = func(addr string) bool { return addr == healthy }
+	opts.MinHealthyReplicas = 2
+	_, err := sendBatch(opts, addrs, nodeContext)
+	if iErr, ok := err.(insufficientHealthyReplicasError); !ok {
+		t.Errorf("expected insufficientHealthyReplicasError, got %v", err)
+	} else if iErr.CanRetry() {
+		t.Errorf("expected %v not to be retryable", iErr)
+	}
+	if len(sentTo) != 0 {
+		t.Errorf("expected nothing to be sent, sent to %v", sentTo)
+	}
+
+	opts.MinHealthyReplicas = 1
+	if _, err := sendBatch(opts, addrs, nodeContext); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestUnexpectedReply verifies that a reply without a matching attempt, e.g.
+// one missing its address, finishes the attempt in flight instead of leaving
+// send waiting for another reply.
+func TestUnexpectedReply(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	_, ln := newTestServer(t, nodeContext)
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{
+		Ordering: orderStable,
+		Trace:    sp,
+	}
+
+	testCases := []struct {
+		call   batchCall
+		expErr string
+	}{
+		{batchCall{reply: &roachpb.BatchResponse{}}, ""},
+		{batchCall{err: errors.New("failure")}, "too many errors encountered"},
+	}
+	defer func() { sendOneFn = sendOne }()
+	for i, test := range testCases {
+		call := test.call
+		sendOneFn = func(_ SendOptions, _ *rpc.Context, _ batchClient, done chan batchCall) {
+			done <- call
+		}
+		_, err := sendBatch(opts, []net.Addr{ln.Addr()}, nodeContext)
+		if test.expErr == "" {
+			if err != nil {
+				t.Errorf("%d: unexpected error: %v", i, err)
+			}
+		} else if !testutils.IsError(err, test.expErr) {
+			t.Errorf("%d: expected error %q, got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestSkipUnhealthy verifies that only healthy replicas are sent to when
+// SkipUnhealthy is set, unless none are healthy.
+func TestSkipUnhealthy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	_, ln1 := newTestServer(t, nodeContext)
+	_, ln2 := newTestServer(t, nodeContext)
+	addrs := []net.Addr{ln1.Addr(), ln2.Addr()}
+
+	var sentTo []string
+	sendOneFn = recordingSendOne(&sentTo, errors.New("failure"))
+	defer func() { sendOneFn = sendOne }()
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+
+	testCases := []struct {
+		healthy  map[string]bool
+		expected []string
+	}{
+		{map[string]bool{ln2.Addr().String(): true}, []string{ln2.Addr().String()}},
+		{map[string]bool{}, []string{ln1.Addr().String(), ln2.Addr().String()}},
+	}
+	for i, test := range testCases {
+		sentTo = nil
+		opts := testSendOptions(orderStable, sp)
+		opts.HealthProbe = func(addr string) bool { return test.healthy[addr] }
+		opts.SkipUnhealthy = true
+		_, err := sendBatch(opts, addrs, nodeContext)
+		expErr := fmt.Sprintf("too many errors encountered \\(%d of %d total\\)",
+			len(test.expected), len(test.expected))
+		if !testutils.IsError(err, expErr) {
+			t.Errorf("%d: expected error %q, got %v", i, expErr, err)
+		}
+		if !reflect.DeepEqual(sentTo, test.expected) {
+			t.Errorf("%d: expected to send to %v, got %v", i, test.expected, sentTo)
+		}
+	}
+}
+
+// TestDegradedSendNextTimeout verifies that DegradedSendNextTimeout gives an
+// RPC to an unhealthy replica longer before the next replica is tried.
+func TestDegradedSendNextTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	_, ln1 := newTestServer(t, nodeContext)
+	_, ln2 := newTestServer(t, nodeContext)
+	addrs := []net.Addr{ln1.Addr(), ln2.Addr()}
+
+	var sentTo []string
+	sendOneFn = func(_ SendOptions, _ *rpc.Context, client batchClient, done chan batchCall) {
+		sentTo = append(sentTo, client.remoteAddr)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			done <- batchCall{remoteAddr: client.remoteAddr, reply: &roachpb.BatchResponse{}}
+		}()
+	}
+	defer func() { sendOneFn = sendOne }()
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+
+	testCases := []struct {
+		degradedTimeout time.Duration
+		expSent         int
+	}{
+		{0, 2},
+		{time.Hour, 1},
+	}
+	for i, test := range testCases {
+		sentTo = nil
+		opts := SendOptions{
+			Ordering:                orderStable,
+			SendNextTimeout:         time.Millisecond,
+			DegradedSendNextTimeout: test.degradedTimeout,
+			Timeout:                 10 * time.Second,
+			Trace:                   sp,
+			HealthProbe:             func(string) bool { return false },
+		}
+		if _, err := sendBatch(opts, addrs, nodeContext); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if len(sentTo) != test.expSent {
+			t.Errorf("%d: expected to send to %d replicas, sent to %v", i, test.expSent, sentTo)
+		}
+	}
+}
+
+// TestRewriteForAttempt verifies that RewriteForAttempt is applied to the
+// batch sent for each attempt, with the number of the attempt.
+func TestRewriteForAttempt(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	var addrs []net.Addr
+	for i := 0; i < 3; i++ {
+		_, ln := newTestServer(t, nodeContext)
+		addrs = append(addrs, ln.Addr())
+	}
+
+	var priorities []roachpb.UserPriority
+	sendOneFn = func(_ SendOptions, _ *rpc.Context, client batchClient, done chan batchCall) {
+		priorities = append(priorities, client.args.UserPriority)
+		done <- batchCall{remoteAddr: client.remoteAddr, err: errors.New("failure")}
+	}
+	defer func() { sendOneFn = sendOne }()
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{
+		Ordering:        orderStable,
+		SendNextTimeout: 1 * time.Second,
+		Timeout:         10 * time.Second,
+		Trace:           sp,
+		RewriteForAttempt: func(attempt int, args *roachpb.BatchRequest) {
+			args.UserPriority = roachpb.UserPriority(attempt)
+		},
+	}
+	if _, err := sendBatch(opts, addrs, nodeContext); err == nil {
+		t.Fatal("expected all replicas to fail")
+	}
+	if expected := []roachpb.UserPriority{1, 2, 3}; !reflect.DeepEqual(priorities, expected) {
+		t.Errorf("expected priorities %v, got %v", expected, priorities)
+	}
+}
+
+// TestCancelLosingAttempts verifies that attempts still in flight are
+// cancelled once a reply has been accepted, and that a reply failing
+// verification does not cancel the other attempts.
+func TestCancelLosingAttempts(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	var addrs []net.Addr
+	for i := 0; i < 3; i++ {
+		_, ln := newTestServer(t, nodeContext)
+		addrs = append(addrs, ln.Addr())
+	}
+
+	// Checksum the value for the wrong key so that verification fails.
+	value := roachpb.MakeValueFromString("value")
+	value.InitChecksum(roachpb.Key("b"))
+	corrupt := &roachpb.BatchResponse{}
+	corrupt.Add(&roachpb.GetResponse{Value: &value})
+	valid := &roachpb.BatchResponse{}
+	valid.Add(&roachpb.GetResponse{})
+
+	loserCancelled := make(chan struct{})
+	sendOneFn = func(opts SendOptions, _ *rpc.Context, client batchClient, done chan batchCall) {
+		switch client.remoteAddr {
+		case addrs[0].String():
+			// Fast but corrupt.
+			done <- makeBatchCall(opts, &client, corrupt, nil)
+		case addrs[1].String():
+			// Slower but valid, and must not have been cancelled.
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				done <- makeBatchCall(opts, &client, valid, opts.Context.Err())
+			}()
+		case addrs[2].String():
+			// Never replies unless cancelled.
+			go func() {
+				<-opts.Context.Done()
+				close(loserCancelled)
+				done <- makeBatchCall(opts, &client, nil, opts.Context.Err())
+			}()
+		}
+	}
+	defer func() { sendOneFn = sendOne }()
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{
+		Ordering:         orderStable,
+		SendNextTimeout:  10 * time.Millisecond,
+		Timeout:          10 * time.Second,
+		Trace:            sp,
+		VerificationMode: verifyFail,
+	}
+	var args roachpb.BatchRequest
+	args.Add(roachpb.NewGet(roachpb.Key("a")))
+	reply, err := send(opts, makeReplicas(addrs...), args, nodeContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != valid {
+		t.Errorf("expected the valid reply to win, got %+v", reply)
+	}
+
+	select {
+	case <-loserCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("losing attempt was not cancelled")
+	}
+}
+
+// TestRefreshHealthOnFailover verifies that a replica which becomes unhealthy
+// after the replicas were ordered is tried after the healthy ones.
+func TestRefreshHealthOnFailover(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	clientStopper := stop.NewStopper()
+	defer clientStopper.Stop()
+	clientContext := newNodeTestContext(nil, clientStopper)
+
+	var addrs []net.Addr
+	var serverStoppers []*stop.Stopper
+	for i := 0; i < 3; i++ {
+		serverStopper := stop.NewStopper()
+		if i != 1 {
+			// The second server is stopped by the test itself.
+			defer serverStopper.Stop()
+		}
+		serverStoppers = append(serverStoppers, serverStopper)
+		_, ln := newTestServer(t, newNodeTestContext(nil, serverStopper))
+		addrs = append(addrs, ln.Addr())
+		// Make sure all replicas start out healthy.
+		conn, err := clientContext.GRPCDial(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForConnState(t, conn, grpc.Ready)
+	}
+
+	var sentTo []string
+	sendOneFn = func(_ SendOptions, _ *rpc.Context, client batchClient, done chan batchCall) {
+		sentTo = append(sentTo, client.remoteAddr)
+		call := batchCall{remoteAddr: client.remoteAddr, reply: &roachpb.BatchResponse{}}
+		if len(sentTo) == 1 {
+			// Take down the second replica before failing the first.
+			serverStoppers[1].Stop()
+			conn, err := clientContext.GRPCDial(addrs[1].String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			waitForConnState(t, conn, grpc.TransientFailure)
+			call.reply, call.err = nil, errors.New("failure")
+		}
+		done <- call
+	}
+	defer func() { sendOneFn = sendOne }()
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	// All round-trip times are unknown, so orderClosest keeps the healthy
+	// replicas in the order provided.
+	opts := testSendOptions(orderClosest, sp)
+	if _, err := sendBatch(opts, addrs, clientContext); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{addrs[0].String(), addrs[2].String()}
+	if !reflect.DeepEqual(sentTo, expected) {
+		t.Errorf("expected to send to %v, got %v", expected, sentTo)
+	}
+}
+
+// TestCancelPreviousAttempt verifies that trying the next replica cancels the
+// attempt in flight when CancelPreviousAttempt is set.
+func TestCancelPreviousAttempt(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop()
+
+	nodeContext := newNodeTestContext(nil, stopper)
+	var addrs []net.Addr
+	for i := 0; i < 3; i++ {
+		_, ln := newTestServer(t, nodeContext)
+		addrs = append(addrs, ln.Addr())
+	}
+
+	var firstCtx context.Context
+	var attempts int
+	sendOneFn = func(opts SendOptions, _ *rpc.Context, client batchClient, done chan batchCall) {
+		attempts++
+		switch attempts {
+		case 1:
+			// Stuck until cancelled.
+			firstCtx = opts.Context
+			go func() {
+				<-opts.Context.Done()
+				done <- batchCall{remoteAddr: client.remoteAddr, err: opts.Context.Err()}
+			}()
+		case 2:
+			if err := firstCtx.Err(); err != context.Canceled {
+				t.Errorf("expected first attempt to be cancelled, got %v", err)
+			}
+			done <- batchCall{remoteAddr: client.remoteAddr, reply: &roachpb.BatchResponse{}}
+		default:
+			t.Errorf("unexpected attempt %d on %s", attempts, client.remoteAddr)
+			done <- batchCall{remoteAddr: client.remoteAddr, err: errors.New("unexpected")}
+		}
+	}
+	defer func() { sendOneFn = sendOne }()
+
+	sp := tracing.NewTracer().StartSpan("node test")
+	defer sp.Finish()
+	opts := SendOptions{
+		Ordering:              orderStable,
+		SendNextTimeout:       10 * time.Millisecond,
+		Timeout:               10 * time.Second,
+		Trace:                 sp,
+		CancelPreviousAttempt: true,
+	}
+	if _, err := sendBatch(opts, addrs, nodeContext); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func makeReplicas(addrs ...net.Addr) ReplicaSlice {
+	replicas := make(ReplicaSlice, len(addrs))
+	for i, addr := range addrs {
+		replicas[i].NodeDesc = &roachpb.NodeDescriptor{
+			Address: util.MakeUnresolvedAddr(addr.Network(), addr.String()),
+		}
+	}
+	return replicas
+}
+
+// recordingSendOne returns a mock of sendOne which appends the address of each
+// replica sent to to *sentTo, and fails the attempt with err or, if err is
+// nil, replies successfully.
+func recordingSendOne(sentTo *[]string, err error) func(SendOptions, *rpc.Context, batchClient, chan batchCall) {
+	return func(_ SendOptions, _ *rpc.Context, client batchClient, done chan batchCall) {
+		*sentTo = append(*sentTo, client.remoteAddr)
+		call := batchCall{remoteAddr: client.remoteAddr, err: err}
+		if err == nil {
+			call.reply = &roachpb.BatchResponse{}
+		}
+		done <- call
+	}
+}
+
+// testSendOptions returns the SendOptions used by tests which mock sendOne:
+// generous timeouts, so that only failures cause the next replica to be
+// tried.
+func testSendOptions(ordering orderingPolicy, sp opentracing.Span) SendOptions {
+	return SendOptions{
+		Ordering:        ordering,
+		SendNextTimeout: 1 * time.Second,
+		Timeout:         10 * time.Second,
+		Trace:           sp,
+	}
 }
 
 // sendBatch sends Batch requests to specified addresses using send.
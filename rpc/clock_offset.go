@@ -153,6 +153,20 @@ func (r *RemoteClockMonitor) UpdateOffset(addr string, offset RemoteOffset) {
 	}
 }
 
+// Latency returns the round-trip time to addr as estimated from the
+// uncertainty of its current clock offset measurement. The second return
+// value is false if there is no measurement for addr.
+func (r *RemoteClockMonitor) Latency(addr string) (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, ok := r.mu.offsets[addr]
+	if !ok {
+		return 0, false
+	}
+	return 2 * time.Duration(o.Uncertainty), true
+}
+
 // MonitorRemoteOffsets periodically checks that the offset of this server's
 // clock from the true cluster time is within MaxOffset. If the offset exceeds
 // MaxOffset, then this method will trigger a fatal error, causing the node to
@@ -73,6 +73,25 @@ func TestUpdateOffset(t *testing.T) {
 	}
 }
 
+// TestLatency tests that Latency reports twice the offset uncertainty of a
+// measured addr and nothing for an unknown one.
+func TestLatency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	monitor := newRemoteClockMonitor(hlc.NewClock(hlc.UnixNano))
+
+	if _, ok := monitor.Latency("addr"); ok {
+		t.Errorf("expected no latency for unmeasured addr")
+	}
+	monitor.UpdateOffset("addr", RemoteOffset{
+		Offset:      0,
+		Uncertainty: 10,
+		MeasuredAt:  1,
+	})
+	if l, ok := monitor.Latency("addr"); !ok || l != 20 {
+		t.Errorf("expected latency 20ns, got %s (%t)", l, ok)
+	}
+}
+
 // TestEndpointListSort tests the sort interface for endpointLists.
 func TestEndpointListSort(t *testing.T) {
 	defer leaktest.AfterTest(t)()